@@ -0,0 +1,55 @@
+package main
+
+import (
+	"backup/catalog"
+	"backup/repo"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+func GetRepoBackups(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+	rh := repo.NewRepositoryHandler(backend)
+	ok, err := rh.IsExists(uuid)
+	if err != nil {
+		writeFailure(w, r, "load repository "+uuid+" failed", err)
+		return
+	}
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "repository "+uuid+" is not found", nil)
+		return
+	}
+
+	ch := catalog.NewCatalogHandler(backend)
+	artifacts, err := ch.ListByRepo(uuid)
+	if err != nil {
+		writeFailure(w, r, "list backups of repository "+uuid+" failed", err)
+		return
+	}
+	json.NewEncoder(w).Encode(artifacts)
+}
+
+func GetImageBackups(w http.ResponseWriter, r *http.Request) {
+	poolName := mux.Vars(r)["pool_name"]
+	imgName := mux.Vars(r)["img_name"]
+
+	ch := catalog.NewCatalogHandler(backend)
+	artifacts, err := ch.ListByImage(clusterName(r), poolName, imgName)
+	if err != nil {
+		writeFailure(w, r, "list backups of image "+imgName+" in pool "+poolName+" failed", err)
+		return
+	}
+	json.NewEncoder(w).Encode(artifacts)
+}
+
+func GetBackup(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+	ch := catalog.NewCatalogHandler(backend)
+	artifact, err := ch.LoadArtifact(uuid)
+	if err != nil {
+		writeFailure(w, r, "load backup "+uuid+" failed", err)
+		return
+	}
+	json.NewEncoder(w).Encode(artifact)
+}
@@ -0,0 +1,256 @@
+package catalog
+
+import (
+	"backup/cluster"
+	"backup/storage"
+	"backup/store"
+	"backup/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	TypeFull = "full"
+	TypeDiff = "diff"
+)
+
+// Artifact is a file written into a repository by a backup job
+type Artifact struct {
+	Uuid        string `json:"uuid"`
+	RepoUuid    string `json:"repo_uuid"`
+	Pool        string `json:"pool"`
+	Cluster     string `json:"cluster,omitempty"` // the default cluster if empty
+	Image       string `json:"image"`
+	Type        string `json:"type"`
+	FromSnap    string `json:"from_snap,omitempty"`
+	ToSnap      string `json:"to_snap,omitempty"`
+	File        string `json:"file"` // relative to repository path
+	Size        uint64 `json:"size"`
+	Checksum    string `json:"checksum"`              // sha256
+	Compression string `json:"compression,omitempty"` // codec of the file, none if empty
+	Encrypted   bool   `json:"encrypted,omitempty"`
+	JobUuid     string `json:"job_uuid"`
+	CreatedTime uint64 `json:"created_time"`
+}
+
+// ClusterName returns the cluster the image was backed up from
+func (a *Artifact) ClusterName() string {
+	if a.Cluster == "" {
+		return cluster.Default
+	}
+	return a.Cluster
+}
+
+type CatalogHandler struct {
+	rh store.Store
+}
+
+func NewCatalogHandler(backend store.Backend) *CatalogHandler {
+	rh := backend.Namespace("catalog")
+	return &CatalogHandler{rh}
+}
+
+// sameBackup tells whether both artifacts back up the same snapshots of the same image
+// into the same repository
+func (a *Artifact) sameBackup(b *Artifact) bool {
+	return a.RepoUuid == b.RepoUuid && a.ClusterName() == b.ClusterName() && a.Pool == b.Pool && a.Image == b.Image &&
+		a.Type == b.Type && a.FromSnap == b.FromSnap && a.ToSnap == b.ToSnap
+}
+
+// AddArtifact records an artifact, the records of any older backup of the
+// same snapshots of the image in the repository are removed
+func (ch *CatalogHandler) AddArtifact(a *Artifact) (string, error) {
+	artifacts, err := ch.ListArtifact()
+	if err != nil {
+		return "", err
+	}
+	for i := range artifacts {
+		if old := &artifacts[i]; old.sameBackup(a) {
+			ch.rh.Delete(old.Uuid)
+		}
+	}
+
+	uuid, err := utils.MakeUuid()
+	if err != nil {
+		return "", err
+	}
+	a.Uuid = uuid
+	a.CreatedTime = uint64(time.Now().Unix())
+	err = ch.rh.Add(a, uuid)
+	return uuid, err
+}
+
+func (ch *CatalogHandler) LoadArtifact(uuid string) (*Artifact, error) {
+	bs, err := ch.rh.Load(uuid)
+	if err != nil {
+		return &Artifact{}, err
+	}
+	a := Artifact{}
+	err = json.Unmarshal(bs, &a)
+	if err != nil {
+		return &Artifact{}, err
+	}
+	return &a, nil
+}
+
+// ListArtifact returns all artifacts, oldest first
+func (ch *CatalogHandler) ListArtifact() ([]Artifact, error) {
+	list, err := ch.rh.List()
+	if err != nil {
+		return []Artifact{}, err
+	}
+
+	artifacts := make([]Artifact, 0)
+	for _, s := range list {
+		a := Artifact{}
+		err := json.Unmarshal([]byte(s), &a)
+		if err != nil {
+			continue
+		}
+		artifacts = append(artifacts, a)
+	}
+	sort.SliceStable(artifacts, func(i, j int) bool {
+		return artifacts[i].CreatedTime < artifacts[j].CreatedTime
+	})
+	return artifacts, nil
+}
+
+func (ch *CatalogHandler) ListByRepo(repoUuid string) ([]Artifact, error) {
+	return ch.filter(func(a *Artifact) bool {
+		return a.RepoUuid == repoUuid
+	})
+}
+
+func (ch *CatalogHandler) ListByImage(clusterName string, pool string, image string) ([]Artifact, error) {
+	return ch.filter(func(a *Artifact) bool {
+		return a.ClusterName() == clusterName && a.Pool == pool && a.Image == image
+	})
+}
+
+func (ch *CatalogHandler) filter(fn func(*Artifact) bool) ([]Artifact, error) {
+	artifacts, err := ch.ListArtifact()
+	if err != nil {
+		return []Artifact{}, err
+	}
+	filtered := make([]Artifact, 0)
+	for i := range artifacts {
+		if fn(&artifacts[i]) {
+			filtered = append(filtered, artifacts[i])
+		}
+	}
+	return filtered, nil
+}
+
+func (ch *CatalogHandler) UpdateArtifact(a *Artifact) error {
+	return ch.rh.Update(a, a.Uuid)
+}
+
+func (ch *CatalogHandler) RemoveArtifact(uuid string) error {
+	return ch.rh.Delete(uuid)
+}
+
+// Checksum returns the size and sha256 of a file
+func Checksum(path string) (uint64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return uint64(n), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Summer is a file which sums what is written to it
+type Summer interface {
+	storage.File
+	// Sum returns the size and sha256 of the file
+	Sum() (uint64, string)
+}
+
+type summer struct {
+	storage.File
+	hash hash.Hash
+	size uint64
+}
+
+// NewSummer sums what is written to f. If f is seekable so is the summer, as long as it
+// only seeks forward like rbd export over holes, which are summed as zeros.
+func NewSummer(f storage.File) Summer {
+	s := &summer{File: f, hash: sha256.New()}
+	seeker, ok := f.(io.Seeker)
+	t, ok2 := f.(truncater)
+	if ok && ok2 {
+		return &seekingSummer{s, seeker, t}
+	}
+	return s
+}
+
+func (s *summer) Write(p []byte) (int, error) {
+	n, err := s.File.Write(p)
+	s.hash.Write(p[:n])
+	s.size += uint64(n)
+	return n, err
+}
+
+func (s *summer) Sum() (uint64, string) {
+	return s.size, hex.EncodeToString(s.hash.Sum(nil))
+}
+
+// zeros sums n zero bytes
+func (s *summer) zeros(n uint64) {
+	zeros := make([]byte, 1<<20)
+	for n > 0 {
+		m := n
+		if m > uint64(len(zeros)) {
+			m = uint64(len(zeros))
+		}
+		s.hash.Write(zeros[:m])
+		s.size += m
+		n -= m
+	}
+}
+
+type truncater interface {
+	Truncate(size int64) error
+}
+
+type seekingSummer struct {
+	*summer
+	seeker io.Seeker
+	t      truncater
+}
+
+func (s *seekingSummer) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart || uint64(offset) < s.size {
+		return 0, errors.New("summed file can only seek forward from start")
+	}
+	n, err := s.seeker.Seek(offset, whence)
+	if err != nil {
+		return n, err
+	}
+	s.zeros(uint64(offset) - s.size)
+	return n, nil
+}
+
+func (s *seekingSummer) Truncate(size int64) error {
+	if uint64(size) < s.size {
+		return errors.New("summed file can not be shrunk")
+	}
+	if err := s.t.Truncate(size); err != nil {
+		return err
+	}
+	s.zeros(uint64(size) - s.size)
+	return nil
+}
@@ -0,0 +1,93 @@
+package catalog
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// snapBefore compares snapshots named by timestamp
+func snapBefore(a string, b string) bool {
+	x, errX := strconv.Atoi(a)
+	y, errY := strconv.Atoi(b)
+	if errX != nil || errY != nil {
+		return a < b
+	}
+	return x < y
+}
+
+// Chain resolves the full backup and the ordered diffs which bring an image
+// to the target snapshot. The artifacts must belong to the same image of the
+// same repository. The newest full backup with a continuous chain of diffs
+// up to the target is preferred.
+func Chain(artifacts []Artifact, target string) ([]Artifact, error) {
+	fulls := make([]Artifact, 0)
+	diffs := make(map[string][]Artifact) // keyed by from snapshot
+	for _, a := range artifacts {
+		switch {
+		case a.Type == TypeFull && a.ToSnap != "" && !snapBefore(target, a.ToSnap):
+			fulls = append(fulls, a)
+		case a.Type == TypeDiff && !snapBefore(target, a.ToSnap):
+			diffs[a.FromSnap] = append(diffs[a.FromSnap], a)
+		}
+	}
+	if len(fulls) == 0 {
+		return nil, errors.New("no full backup of a snapshot at or before " + target)
+	}
+	sort.Slice(fulls, func(i, j int) bool {
+		return snapBefore(fulls[j].ToSnap, fulls[i].ToSnap)
+	})
+
+	var broken string
+	for _, full := range fulls {
+		if path := follow(diffs, full.ToSnap, target, make(map[string]bool)); path != nil {
+			return append([]Artifact{full}, path...), nil
+		}
+		if broken == "" {
+			broken = full.ToSnap
+		}
+	}
+	return nil, errors.New("no continuous chain of diffs from snapshot " + broken + " to " + target)
+}
+
+// follow searches diffs from snapshot to target, the diffs reaching
+// furthest are tried first to keep the chain short
+func follow(diffs map[string][]Artifact, from string, target string, visited map[string]bool) []Artifact {
+	if from == target {
+		return []Artifact{}
+	}
+	if visited[from] {
+		return nil
+	}
+	visited[from] = true
+
+	next := append([]Artifact{}, diffs[from]...)
+	sort.Slice(next, func(i, j int) bool {
+		return snapBefore(next[j].ToSnap, next[i].ToSnap)
+	})
+	for _, d := range next {
+		if path := follow(diffs, d.ToSnap, target, visited); path != nil {
+			return append([]Artifact{d}, path...)
+		}
+	}
+	return nil
+}
+
+// Base returns the newest snapshot accepted by usable which the artifacts can
+// restore, empty if there is none. The artifacts must belong to the same image
+// of the same repository.
+func Base(artifacts []Artifact, usable func(snap string) bool) string {
+	base := ""
+	for _, a := range artifacts {
+		if a.ToSnap == "" || !usable(a.ToSnap) {
+			continue
+		}
+		if base != "" && !snapBefore(base, a.ToSnap) {
+			continue
+		}
+		if _, err := Chain(artifacts, a.ToSnap); err == nil {
+			base = a.ToSnap
+		}
+	}
+	return base
+}
@@ -0,0 +1,143 @@
+package catalog
+
+import (
+	"strings"
+	"testing"
+)
+
+func full(snap string) Artifact {
+	return Artifact{Type: TypeFull, ToSnap: snap, File: "img@" + snap}
+}
+
+func diff(from string, to string) Artifact {
+	return Artifact{Type: TypeDiff, FromSnap: from, ToSnap: to, File: "img@" + from + "_to_" + to + ".diff"}
+}
+
+func files(chain []Artifact) string {
+	names := make([]string, 0, len(chain))
+	for _, a := range chain {
+		names = append(names, a.File)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestChain(t *testing.T) {
+	tests := []struct {
+		name      string
+		artifacts []Artifact
+		target    string
+		want      string // files of the chain, empty if it is broken
+	}{
+		{
+			name:      "full",
+			artifacts: []Artifact{full("100")},
+			target:    "100",
+			want:      "img@100",
+		},
+		{
+			name:      "diffs",
+			artifacts: []Artifact{diff("200", "300"), full("100"), diff("100", "200"), diff("300", "400")},
+			target:    "300",
+			want:      "img@100 img@100_to_200.diff img@200_to_300.diff",
+		},
+		{
+			name:      "newest full",
+			artifacts: []Artifact{full("100"), diff("100", "200"), full("200"), diff("200", "300")},
+			target:    "300",
+			want:      "img@200 img@200_to_300.diff",
+		},
+		{
+			name:      "full after target",
+			artifacts: []Artifact{full("100"), diff("100", "200"), full("300")},
+			target:    "200",
+			want:      "img@100 img@100_to_200.diff",
+		},
+		{
+			name:      "longest diff first",
+			artifacts: []Artifact{full("100"), diff("100", "200"), diff("200", "300"), diff("100", "300")},
+			target:    "300",
+			want:      "img@100 img@100_to_300.diff",
+		},
+		{
+			name:      "dead end",
+			artifacts: []Artifact{full("100"), diff("100", "150"), diff("100", "200"), diff("200", "300")},
+			target:    "300",
+			want:      "img@100 img@100_to_200.diff img@200_to_300.diff",
+		},
+		{
+			name:      "snapshots compared as numbers",
+			artifacts: []Artifact{full("9"), diff("9", "10"), full("10")},
+			target:    "10",
+			want:      "img@10",
+		},
+		{
+			name:      "broken newest chain",
+			artifacts: []Artifact{full("100"), diff("100", "200"), diff("200", "300"), full("150"), diff("150", "250")},
+			target:    "300",
+			want:      "img@100 img@100_to_200.diff img@200_to_300.diff",
+		},
+		{
+			name:      "gap",
+			artifacts: []Artifact{full("100"), diff("100", "200"), diff("250", "300")},
+			target:    "300",
+		},
+		{
+			name:      "diff past target",
+			artifacts: []Artifact{full("100"), diff("100", "300")},
+			target:    "200",
+		},
+		{
+			name:      "no full",
+			artifacts: []Artifact{diff("100", "200")},
+			target:    "200",
+		},
+		{
+			name:      "target before full",
+			artifacts: []Artifact{full("200")},
+			target:    "100",
+		},
+		{
+			name:      "full of image head",
+			artifacts: []Artifact{full("")},
+			target:    "100",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain, err := Chain(test.artifacts, test.target)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("chain %s, want error", files(chain))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := files(chain); got != test.want {
+				t.Errorf("chain %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBase(t *testing.T) {
+	all := func(string) bool { return true }
+	tests := []struct {
+		name      string
+		artifacts []Artifact
+		usable    func(string) bool
+		want      string
+	}{
+		{"none", nil, all, ""},
+		{"newest", []Artifact{full("100"), diff("100", "200"), diff("200", "300")}, all, "300"},
+		{"deleted snapshot", []Artifact{full("100"), diff("100", "200"), diff("200", "300")}, func(s string) bool { return s != "300" }, "200"},
+		{"broken chain", []Artifact{full("100"), diff("200", "300")}, all, "100"},
+		{"unusable", []Artifact{full("100")}, func(string) bool { return false }, ""},
+	}
+	for _, test := range tests {
+		if got := Base(test.artifacts, test.usable); got != test.want {
+			t.Errorf("%s: base %q, want %q", test.name, got, test.want)
+		}
+	}
+}
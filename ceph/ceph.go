@@ -1,12 +1,21 @@
 package ceph
 
 import (
+	"backup/compress"
+	"backup/crypt"
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"github.com/ceph/go-ceph/rados"
 	"github.com/ceph/go-ceph/rbd"
+	"io"
+	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 	"log"
 )
@@ -25,27 +34,82 @@ type SnapShot struct {
 	Timestamp   int `json:"timestamp"`
 }
 
+// Options tells how to reach a cluster, the default ceph.conf search path
+// is used if ConfigFile is empty
+type Options struct {
+	ConfigFile string
+	Keyring    string
+	ClientId   string
+	RbdPath    string
+	Timeout    time.Duration // monitor and osd operations fail after it instead of hanging, 0 means never
+}
+
 type CephHandler struct {
 	conn *rados.Conn
+	opts Options
 }
 
-func NewCephHandler() (*CephHandler, error) {
-	conn, err := rados.NewConn()
+func NewCephHandler(opts Options) (*CephHandler, error) {
+	conn, err := rados.NewConnWithUser(opts.ClientId)
 	if err != nil {
 		return nil, err
 	}
 
-	err = conn.ReadDefaultConfigFile()
-	if err != nil {
+	if err := configure(conn, opts); err != nil {
+		conn.Shutdown()
 		return nil, err
 	}
 
 	err = conn.Connect()
 	if err != nil {
+		conn.Shutdown()
 		return nil, err
 	}
 
-	return &CephHandler{conn}, nil
+	return &CephHandler{conn, opts}, nil
+}
+
+func configure(conn *rados.Conn, opts Options) error {
+	var err error
+	if opts.ConfigFile == "" {
+		err = conn.ReadDefaultConfigFile()
+	} else {
+		err = conn.ReadConfigFile(opts.ConfigFile)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.Keyring != "" {
+		if err := conn.SetConfigOption("keyring", opts.Keyring); err != nil {
+			return err
+		}
+	}
+	if opts.Timeout > 0 {
+		seconds := strconv.Itoa(int(opts.Timeout.Seconds()))
+		for _, option := range []string{"client_mount_timeout", "rados_mon_op_timeout", "rados_osd_op_timeout"} {
+			if err := conn.SetConfigOption(option, seconds); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rbdCommand builds a command of rbd binary talking to the same cluster as the handler
+func (ch *CephHandler) rbdCommand(args ...string) []string {
+	command := []string{ch.opts.RbdPath, "--id", ch.opts.ClientId}
+	if ch.opts.ConfigFile != "" {
+		command = append(command, "--conf", ch.opts.ConfigFile)
+	}
+	if ch.opts.Keyring != "" {
+		command = append(command, "--keyring", ch.opts.Keyring)
+	}
+	return append(command, args...)
+}
+
+// Shutdown closes the connection, the handler can not be used any more
+func (ch *CephHandler) Shutdown() {
+	ch.conn.Shutdown()
 }
 
 func (ch *CephHandler) ListPool() ([]Pool, error) {
@@ -73,6 +137,11 @@ func (ch *CephHandler) ListPool() ([]Pool, error) {
 	return pools, nil
 }
 
+// IsNotFound tells whether err is returned because a pool, image or snapshot does not exist
+func IsNotFound(err error) bool {
+	return err == rbd.ErrNotFound || err == rados.ErrNotFound
+}
+
 func (ch *CephHandler) LoadImage(pool string, name string) (*Image, error) {
 	ioctx, err := ch.conn.OpenIOContext(pool)
 	if err != nil {
@@ -80,8 +149,8 @@ func (ch *CephHandler) LoadImage(pool string, name string) (*Image, error) {
 	}
 	defer ioctx.Destroy()
 
-	img := rbd.GetImage(ioctx, name)
-	if err := img.Open(true); err != nil {
+	img, err := rbd.OpenImageReadOnly(ioctx, name, rbd.NoSnapshot)
+	if err != nil {
 		return nil, err
 	}
 	defer img.Close()
@@ -93,6 +162,94 @@ func (ch *CephHandler) LoadImage(pool string, name string) (*Image, error) {
 	return &Image{name, info.Size}, nil
 }
 
+// CheckOverwritable fails if the image has a protected snapshot or a snapshot with
+// clones, removing it would break the clones or leave it half removed
+func (ch *CephHandler) CheckOverwritable(pool string, name string) error {
+	ioctx, err := ch.conn.OpenIOContext(pool)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	img, err := rbd.OpenImageReadOnly(ioctx, name, rbd.NoSnapshot)
+	if err != nil {
+		return err
+	}
+	infos, err := img.GetSnapshotNames()
+	img.Close()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		snap, err := rbd.OpenImageReadOnly(ioctx, name, info.Name)
+		if err != nil {
+			return err
+		}
+		_, children, err := snap.ListChildren()
+		if err != nil {
+			snap.Close()
+			return err
+		}
+		protected, err := snap.GetSnapshot(info.Name).IsProtected()
+		snap.Close()
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return errors.New("snapshot " + info.Name + " of image " + name + " has clones " + strings.Join(children, ", "))
+		}
+		if protected {
+			return errors.New("snapshot " + info.Name + " of image " + name + " is protected")
+		}
+	}
+	return nil
+}
+
+// RemoveImage removes an image together with all of its snapshots
+func (ch *CephHandler) RemoveImage(pool string, name string) error {
+	ioctx, err := ch.conn.OpenIOContext(pool)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	img, err := rbd.OpenImage(ioctx, name, rbd.NoSnapshot)
+	if err != nil {
+		return err
+	}
+	infos, err := img.GetSnapshotNames()
+	if err != nil {
+		img.Close()
+		return err
+	}
+	for _, info := range infos {
+		snapshot := img.GetSnapshot(info.Name)
+		if protected, _ := snapshot.IsProtected(); protected {
+			if err := snapshot.Unprotect(); err != nil {
+				img.Close()
+				return err
+			}
+		}
+		if err := snapshot.Remove(); err != nil {
+			img.Close()
+			return err
+		}
+	}
+	img.Close()
+	return rbd.RemoveImage(ioctx, name)
+}
+
+// RenameImage renames an image within its pool, its snapshots are kept
+func (ch *CephHandler) RenameImage(pool string, name string, newName string) error {
+	ioctx, err := ch.conn.OpenIOContext(pool)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	return rbd.GetImage(ioctx, name).Rename(newName)
+}
+
 func (ch *CephHandler) ListImage(pool string) ([]Image, error) {
 	ioctx, err := ch.conn.OpenIOContext(pool)
 	if err != nil {
@@ -108,8 +265,7 @@ func (ch *CephHandler) ListImage(pool string) ([]Image, error) {
 	images := make([]Image, 0)
 
 	for _, name := range imgNames {
-		img := rbd.GetImage(ioctx, name)
-		err := img.Open(true)
+		img, err := rbd.OpenImageReadOnly(ioctx, name, rbd.NoSnapshot)
 		if err != nil {
 			continue
 		}
@@ -123,6 +279,17 @@ func (ch *CephHandler) ListImage(pool string) ([]Image, error) {
 	return images, nil
 }
 
+// ListImageNames lists the images of pool without opening them
+func (ch *CephHandler) ListImageNames(pool string) ([]string, error) {
+	ioctx, err := ch.conn.OpenIOContext(pool)
+	if err != nil {
+		return nil, err
+	}
+	defer ioctx.Destroy()
+
+	return rbd.GetImageNames(ioctx)
+}
+
 func (ch *CephHandler) ListSnapshot(pool string, imgName string) ([]SnapShot, error){
 	ioctx, err := ch.conn.OpenIOContext(pool)
 	if err != nil {
@@ -130,8 +297,8 @@ func (ch *CephHandler) ListSnapshot(pool string, imgName string) ([]SnapShot, er
 	}
 	defer ioctx.Destroy()
 
-	img := rbd.GetImage(ioctx, imgName)
-	if err := img.Open(true); err != nil {
+	img, err := rbd.OpenImageReadOnly(ioctx, imgName, rbd.NoSnapshot)
+	if err != nil {
 		return nil, err
 	}
 	defer img.Close()
@@ -153,21 +320,41 @@ func (ch *CephHandler) ListSnapshot(pool string, imgName string) ([]SnapShot, er
 	return snaps, nil
 }
 
-func (ch *CephHandler) CreateSnapshot(pool string, imgName string) error {
+// CreateSnapshot creates a snapshot named by current timestamp and returns its name
+func (ch *CephHandler) CreateSnapshot(pool string, imgName string) (string, error) {
 	ioctx, err := ch.conn.OpenIOContext(pool)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer ioctx.Destroy()
 
-	img := rbd.GetImage(ioctx, imgName)
-	if err := img.Open(); err != nil {
-		return err
+	img, err := rbd.OpenImage(ioctx, imgName, rbd.NoSnapshot)
+	if err != nil {
+		return "", err
 	}
 	defer img.Close()
 
 	timestamp := time.Now().Unix()
 	name := strconv.Itoa(int(timestamp))
+	_, err = img.CreateSnapshot(name)
+	return name, err
+}
+
+// CreateNamedSnapshot creates a snapshot with the given name, it is used to
+// recreate the base snapshot which import-diff requires after a restore
+func (ch *CephHandler) CreateNamedSnapshot(pool string, imgName string, name string) error {
+	ioctx, err := ch.conn.OpenIOContext(pool)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	img, err := rbd.OpenImage(ioctx, imgName, rbd.NoSnapshot)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
 	_, err = img.CreateSnapshot(name)
 	return err
 }
@@ -179,8 +366,8 @@ func (ch *CephHandler) RemoveSnapshot(pool string, imgName string, name string)
 	}
 	defer ioctx.Destroy()
 
-	img := rbd.GetImage(ioctx, imgName)
-	if err := img.Open(); err != nil {
+	img, err := rbd.OpenImage(ioctx, imgName, rbd.NoSnapshot)
+	if err != nil {
 		return err
 	}
 	defer img.Close()
@@ -189,8 +376,51 @@ func (ch *CephHandler) RemoveSnapshot(pool string, imgName string, name string)
 	return snapshot.Remove()
 }
 
-func (ch *CephHandler) progressCommand(command []string, fn func(int)) error {
-	cmd := exec.Command(command[0], command[1:]...)
+// CommandError is returned when an rbd command exits with non-zero status,
+// Message keeps the last line the command printed to stderr
+type CommandError struct {
+	Command  []string
+	ExitCode int
+	Message  string
+}
+
+func (e *CommandError) Error() string {
+	msg := "command " + strings.Join(e.Command, " ") + " exited with code " + strconv.Itoa(e.ExitCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *CommandError) ExitStatus() int {
+	return e.ExitCode
+}
+
+// scanLines splits rbd output on '\r' as well as '\n', rbd rewrites the progress line with '\r'
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// ProgressFunc receives the bytes done out of the total bytes of an operation
+type ProgressFunc func(done uint64, total uint64)
+
+// progressCommand runs the command until it exits and reports the percentage parsed from stderr
+// as the share of total bytes if fn is not nil, the command is killed when ctx is cancelled.
+// stdin is fed to the command if not nil.
+func (ch *CephHandler) progressCommand(ctx context.Context, command []string, stdin io.Reader, total uint64, fn ProgressFunc) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
 	stderr, err := cmd.StderrPipe() // ceph rbd command use stderr to print progress
 	if err != nil {
 		log.Println("Open stderr pipe failed")
@@ -200,62 +430,181 @@ func (ch *CephHandler) progressCommand(command []string, fn func(int)) error {
 		log.Println("Execute command failed", command)
 		return err
 	}
-	stop := make(chan bool)
-
-	go func() {
-		tick := time.Tick(100 * time.Millisecond)
-		reader := bufio.NewReader(stderr)
-		re := regexp.MustCompile("[0-9]+")
-		percent := 0
-		for {
-			select {
-			case <-tick:
-				buffer := make([]byte, 1024)
-				n, err := reader.Read(buffer)
-				if err != nil {
-					continue
-				}
-				i, err := strconv.Atoi(re.FindString(string(buffer[:n])))
-				if err == nil && i > percent {
-					percent = i
-					fn(percent)
-				}
-			case <-stop:
-				return
-			}
-		}
-	}()
 
-	go func() {
-		cmd.Wait()
-		stop <- true
-		fn(100) // make sure percentage is 100 when done
-	}()
+	re := regexp.MustCompile("([0-9]+)% complete")
+	percent := 0
+	message := ""
+	scanner := bufio.NewScanner(stderr)
+	scanner.Split(scanLines)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		match := re.FindStringSubmatch(line)
+		if match == nil {
+			message = line
+			continue
+		}
+		if fn == nil {
+			continue
+		}
+		i, err := strconv.Atoi(match[1])
+		if err == nil && i > percent {
+			percent = i
+			fn(total*uint64(percent)/100, total)
+		}
+	}
 
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			log.Println("Command", command, "is cancelled")
+			return ctx.Err()
+		}
+		log.Println("Command", command, "failed:", err)
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			// the command succeeded but stdin could not be read
+			return err
+		}
+		code := -1
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			code = status.ExitStatus()
+		}
+		return &CommandError{command, code, message}
+	}
+	if fn != nil {
+		fn(total, total) // make sure percentage is 100 when done
+	}
 	return nil
 }
 
-func (ch *CephHandler) Backup(pool string, img string, path string, fn func(int)) error {
-	command := []string{"/usr/bin/rbd", "export", "--pool", pool, img, path}
-	err := ch.progressCommand(command, fn)
-	return err
+// Encoding tells how a backup file is transformed on its way to the repository
+type Encoding struct {
+	Compression string          // codec, none if empty
+	Keys        *crypt.Keystore // the file is encrypted with a master key of it if not nil
 }
 
-func (ch *CephHandler) Restore(pool string, path string, fn func(int)) error {
-	command := []string{"/usr/bin/rbd", "import", "--dest-pool", pool, path}
-	err := ch.progressCommand(command, fn)
-	return err
+// Extension returns the suffix of the files written with the encoding
+func (e Encoding) Extension() string {
+	if e.Keys != nil {
+		return compress.Extension(e.Compression) + crypt.Extension
+	}
+	return compress.Extension(e.Compression)
 }
 
-func (ch *CephHandler) IncrementalBackup(pool string, img string, path string, start string, end string, fn func(int)) error {
-	target := img + "@" + end
-	command := []string{"/usr/bin/rbd", "export-diff", "--pool", pool, target, "--from-snap", start, path}
-	err := ch.progressCommand(command, fn)
-	return err
+// Plain tells whether files are the raw stream of rbd
+func (e Encoding) Plain() bool {
+	return (e.Compression == "" || e.Compression == compress.None) && e.Keys == nil
+}
+
+// Backup exports the image at snapshot snap, or image head if snap is empty, to w
+func (ch *CephHandler) Backup(ctx context.Context, pool string, img string, snap string, w io.Writer, enc Encoding, fn ProgressFunc) error {
+	return encode(w, enc, func(w io.Writer) error {
+		return ch.Export(ctx, pool, img, snap, w, fn)
+	})
+}
+
+// Restore imports the full backup read from r as image img, size is the size of r
+func (ch *CephHandler) Restore(ctx context.Context, pool string, img string, r io.Reader, size uint64, enc Encoding, fn ProgressFunc) error {
+	command := ch.rbdCommand("import", "--dest-pool", pool, "-", img)
+	return ch.importStream(ctx, command, r, size, enc, fn)
+}
+
+// RestoreFile imports the plain full backup stored in the local file at path as image img
+func (ch *CephHandler) RestoreFile(ctx context.Context, pool string, img string, path string, fn ProgressFunc) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	command := ch.rbdCommand("import", "--dest-pool", pool, path, img)
+	return ch.progressCommand(ctx, command, nil, uint64(info.Size()), fn)
+}
+
+// IncrementalBackup exports the changes of the image from snapshot start to end to w
+func (ch *CephHandler) IncrementalBackup(ctx context.Context, pool string, img string, w io.Writer, start string, end string, enc Encoding, fn ProgressFunc) error {
+	return encode(w, enc, func(w io.Writer) error {
+		return ch.ExportDiff(ctx, pool, img, start, end, w, fn)
+	})
+}
+
+// IncrementalRestore applies the diff read from r to image img, size is the size of r
+func (ch *CephHandler) IncrementalRestore(ctx context.Context, pool string, img string, r io.Reader, size uint64, enc Encoding, fn ProgressFunc) error {
+	command := ch.rbdCommand("import-diff", "--pool", pool, "-", img)
+	return ch.importStream(ctx, command, r, size, enc, fn)
+}
+
+// IncrementalRestoreFile applies the plain diff stored in the local file at path to image img
+func (ch *CephHandler) IncrementalRestoreFile(ctx context.Context, pool string, img string, path string, fn ProgressFunc) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	command := ch.rbdCommand("import-diff", "--pool", pool, path, img)
+	return ch.progressCommand(ctx, command, nil, uint64(info.Size()), fn)
 }
 
-func (ch *CephHandler) IncrementalRestore(pool string, img string, path string, fn func(int)) error {
-	command := []string{"/usr/bin/rbd", "import-diff", "--pool", pool, path, img}
-	err := ch.progressCommand(command, fn)
+// encode passes write a writer which compresses and then encrypts into w. Plain
+// streams are written to w directly so that holes are kept sparse if it is a file.
+func encode(w io.Writer, enc Encoding, write func(w io.Writer) error) error {
+	if enc.Plain() {
+		return write(w)
+	}
+	closers := make([]io.Closer, 0, 2)
+	if enc.Keys != nil {
+		ew, err := crypt.NewWriter(w, enc.Keys)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, ew)
+		w = ew
+	}
+	cw, err := compress.NewWriter(enc.Compression, w)
+	if err != nil {
+		return err
+	}
+	closers = append(closers, cw)
+
+	err = write(cw)
+	// the outer writers flush into the inner ones
+	for i := len(closers) - 1; i >= 0; i-- {
+		if cerr := closers[i].Close(); err == nil {
+			err = cerr
+		}
+	}
 	return err
 }
+
+// importStream runs an import command which reads the decoded stream from stdin,
+// rbd can not tell the size of a stream so progress is only the share of r read
+func (ch *CephHandler) importStream(ctx context.Context, command []string, r io.Reader, size uint64, enc Encoding, fn ProgressFunc) error {
+	r = &progressReader{r: r, total: size, fn: fn}
+	if enc.Keys != nil {
+		var err error
+		r, err = crypt.NewReader(r, enc.Keys)
+		if err != nil {
+			return err
+		}
+	}
+	d, err := compress.NewReader(enc.Compression, r)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return ch.progressCommand(ctx, command, d, 0, nil)
+}
+
+// progressReader reports the bytes read from r
+type progressReader struct {
+	r     io.Reader
+	done  uint64
+	total uint64
+	fn    ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += uint64(n)
+	p.fn(p.done, p.total)
+	return n, err
+}
@@ -0,0 +1,265 @@
+package ceph
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/ceph/go-ceph/rbd"
+	"io"
+)
+
+// data is read from the image and written in pieces of at most chunkSize bytes
+const chunkSize = 4 << 20
+
+// header of the format written by `rbd export-diff`
+const diffBanner = "rbd diff v1\n"
+
+type extent struct {
+	offset uint64
+	length uint64
+	exists bool
+}
+
+type truncater interface {
+	Truncate(size int64) error
+}
+
+// extents lists the regions of the opened image which differ from snapshot from,
+// every allocated region is listed if from is empty
+func extents(img *rbd.Image, from string, size uint64, wholeObject bool) ([]extent, error) {
+	list := make([]extent, 0)
+	config := rbd.DiffIterateConfig{
+		SnapName:      from,
+		Offset:        0,
+		Length:        size,
+		IncludeParent: rbd.IncludeParent,
+		WholeObject:   rbd.DisableWholeObject,
+		Callback: func(offset uint64, length uint64, exists int, data interface{}) int {
+			list = append(list, extent{offset, length, exists != 0})
+			return 0
+		},
+	}
+	if wholeObject {
+		config.WholeObject = rbd.EnableWholeObject
+	}
+	if err := img.DiffIterate(config); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// progress counts the bytes read from the image
+type progress struct {
+	fn    ProgressFunc
+	total uint64
+	done  uint64
+}
+
+func (p *progress) add(n uint64) {
+	p.done += n
+	p.fn(p.done, p.total)
+}
+
+// Export writes the image at snapshot snap, or image head if snap is empty, to w
+// in the format of `rbd export`, which is the raw image data. Only the allocated
+// extents are read, holes are skipped by seeking if w is an io.Seeker or written
+// as zeros otherwise.
+func (ch *CephHandler) Export(ctx context.Context, pool string, imgName string, snap string, w io.Writer, fn ProgressFunc) error {
+	ioctx, err := ch.conn.OpenIOContext(pool)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	img, err := rbd.OpenImageReadOnly(ioctx, imgName, snap)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	size, err := img.GetSize()
+	if err != nil {
+		return err
+	}
+	list, err := extents(img, "", size, true)
+	if err != nil {
+		return err
+	}
+	return writeExport(ctx, img, size, list, w, fn)
+}
+
+// writeExport writes the extents of an image of size bytes read from r to w
+func writeExport(ctx context.Context, r io.ReaderAt, size uint64, list []extent, w io.Writer, fn ProgressFunc) error {
+	p := progress{fn: fn}
+	for _, e := range list {
+		if e.exists {
+			p.total += e.length
+		}
+	}
+
+	seeker, seekable := w.(io.Seeker)
+	zeros := make([]byte, chunkSize)
+	buffer := make([]byte, chunkSize)
+	pos := uint64(0)
+	// moveTo advances the output to offset over a hole
+	moveTo := func(offset uint64) error {
+		if seekable {
+			_, err := seeker.Seek(int64(offset), io.SeekStart)
+			pos = offset
+			return err
+		}
+		for pos < offset {
+			n := offset - pos
+			if n > chunkSize {
+				n = chunkSize
+			}
+			if _, err := w.Write(zeros[:n]); err != nil {
+				return err
+			}
+			pos += n
+		}
+		return nil
+	}
+
+	for _, e := range list {
+		if !e.exists {
+			continue
+		}
+		for off := e.offset; off < e.offset+e.length; off += chunkSize {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			n := e.offset + e.length - off
+			if n > chunkSize {
+				n = chunkSize
+			}
+			data := buffer[:n]
+			if _, err := r.ReadAt(data, int64(off)); err != nil && err != io.EOF {
+				return err
+			}
+			// keep the output sparse like rbd does
+			if !(seekable && bytes.Equal(data, zeros[:n])) {
+				if err := moveTo(off); err != nil {
+					return err
+				}
+				if _, err := w.Write(data); err != nil {
+					return err
+				}
+				pos += n
+			}
+			p.add(n)
+		}
+	}
+
+	var err error
+	if t, ok := w.(truncater); ok && seekable {
+		err = t.Truncate(int64(size))
+	} else {
+		err = moveTo(size)
+	}
+	if err != nil {
+		return err
+	}
+	p.add(0)
+	return nil
+}
+
+// ExportDiff writes the changes of the image from snapshot start to end, or
+// all the data of end if start is empty, to w in the format v1 of `rbd export-diff`
+func (ch *CephHandler) ExportDiff(ctx context.Context, pool string, imgName string, start string, end string, w io.Writer, fn ProgressFunc) error {
+	ioctx, err := ch.conn.OpenIOContext(pool)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	img, err := rbd.OpenImageReadOnly(ioctx, imgName, end)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	size, err := img.GetSize()
+	if err != nil {
+		return err
+	}
+	list, err := extents(img, start, size, false)
+	if err != nil {
+		return err
+	}
+	return writeDiff(ctx, img, start, end, size, list, w, fn)
+}
+
+// writeDiff writes the extents of an image of size bytes read from r to w as
+// the diff from snapshot start to end
+func writeDiff(ctx context.Context, r io.ReaderAt, start string, end string, size uint64, list []extent, w io.Writer, fn ProgressFunc) error {
+	p := progress{fn: fn}
+	for _, e := range list {
+		if e.exists {
+			p.total += e.length
+		}
+	}
+
+	header := bytes.NewBufferString(diffBanner)
+	if start != "" {
+		writeRecord(header, 'f', nil, []byte(start))
+	}
+	writeRecord(header, 't', nil, []byte(end))
+	writeRecord(header, 's', []uint64{size}, nil)
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	buffer := make([]byte, chunkSize)
+	for _, e := range list {
+		if !e.exists {
+			if err := writeRecord(w, 'z', []uint64{e.offset, e.length}, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		for off := e.offset; off < e.offset+e.length; off += chunkSize {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			n := e.offset + e.length - off
+			if n > chunkSize {
+				n = chunkSize
+			}
+			data := buffer[:n]
+			if _, err := r.ReadAt(data, int64(off)); err != nil && err != io.EOF {
+				return err
+			}
+			if err := writeRecord(w, 'w', []uint64{off, n}, data); err != nil {
+				return err
+			}
+			p.add(n)
+		}
+	}
+
+	if _, err := w.Write([]byte{'e'}); err != nil {
+		return err
+	}
+	p.add(0)
+	return nil
+}
+
+// writeRecord writes a record of the diff format: a tag followed by little endian
+// numbers, and for the snapshot name records a 32 bit length and the name
+func writeRecord(w io.Writer, tag byte, numbers []uint64, data []byte) error {
+	buffer := bytes.NewBuffer([]byte{tag})
+	for _, n := range numbers {
+		binary.Write(buffer, binary.LittleEndian, n)
+	}
+	if tag == 'f' || tag == 't' {
+		binary.Write(buffer, binary.LittleEndian, uint32(len(data)))
+	}
+	if _, err := w.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		_, err := w.Write(data)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package ceph
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+type record struct {
+	tag     byte
+	numbers []uint64
+	name    string
+	data    []byte
+}
+
+// parseDiff reads the records of a diff in the format v1 of `rbd export-diff`
+func parseDiff(b []byte) ([]record, error) {
+	if !bytes.HasPrefix(b, []byte(diffBanner)) {
+		return nil, errors.New("no banner")
+	}
+	b = b[len(diffBanner):]
+	number := func() uint64 {
+		n := binary.LittleEndian.Uint64(b)
+		b = b[8:]
+		return n
+	}
+	records := make([]record, 0)
+	for len(b) > 0 {
+		r := record{tag: b[0]}
+		b = b[1:]
+		switch r.tag {
+		case 'f', 't':
+			n := binary.LittleEndian.Uint32(b)
+			r.name = string(b[4 : 4+n])
+			b = b[4+n:]
+		case 's':
+			r.numbers = []uint64{number()}
+		case 'z':
+			r.numbers = []uint64{number(), number()}
+		case 'w':
+			r.numbers = []uint64{number(), number()}
+			r.data = b[:r.numbers[1]]
+			b = b[r.numbers[1]:]
+		case 'e':
+			if len(b) != 0 {
+				return nil, errors.New("data after end record")
+			}
+		default:
+			return nil, errors.New("unknown record " + string(r.tag))
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+func image(size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+// tracked records the last progress reported
+type tracked struct {
+	done  uint64
+	total uint64
+}
+
+func (t *tracked) update(done uint64, total uint64) {
+	t.done = done
+	t.total = total
+}
+
+func TestWriteDiff(t *testing.T) {
+	size := uint64(3 * chunkSize)
+	img := image(int(size))
+	list := []extent{
+		{0, 100, true},
+		{4096, chunkSize + 10, true},
+		{2*chunkSize + 100, 200, false},
+	}
+	tests := []struct {
+		start string
+		want  []record
+	}{
+		{"1", []record{
+			{tag: 'f', name: "1"},
+			{tag: 't', name: "2"},
+			{tag: 's', numbers: []uint64{size}},
+			{tag: 'w', numbers: []uint64{0, 100}, data: img[:100]},
+			{tag: 'w', numbers: []uint64{4096, chunkSize}, data: img[4096 : 4096+chunkSize]},
+			{tag: 'w', numbers: []uint64{4096 + chunkSize, 10}, data: img[4096+chunkSize : 4096+chunkSize+10]},
+			{tag: 'z', numbers: []uint64{2*chunkSize + 100, 200}},
+			{tag: 'e'},
+		}},
+		// the whole image up to end has no from snapshot record
+		{"", []record{
+			{tag: 't', name: "2"},
+			{tag: 's', numbers: []uint64{size}},
+			{tag: 'w', numbers: []uint64{0, 100}, data: img[:100]},
+			{tag: 'w', numbers: []uint64{4096, chunkSize}, data: img[4096 : 4096+chunkSize]},
+			{tag: 'w', numbers: []uint64{4096 + chunkSize, 10}, data: img[4096+chunkSize : 4096+chunkSize+10]},
+			{tag: 'z', numbers: []uint64{2*chunkSize + 100, 200}},
+			{tag: 'e'},
+		}},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		p := &tracked{}
+		if err := writeDiff(context.Background(), bytes.NewReader(img), test.start, "2", size, list, &out, p.update); err != nil {
+			t.Fatal(err)
+		}
+		records, err := parseDiff(out.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != len(test.want) {
+			t.Fatalf("from %q: %d records, want %d", test.start, len(records), len(test.want))
+		}
+		for i, r := range records {
+			want := test.want[i]
+			if r.tag != want.tag || r.name != want.name || !equalNumbers(r.numbers, want.numbers) || !bytes.Equal(r.data, want.data) {
+				t.Errorf("from %q: record %d is %c %q %v, want %c %q %v", test.start, i, r.tag, r.name, r.numbers, want.tag, want.name, want.numbers)
+			}
+		}
+		if total := uint64(100 + chunkSize + 10); p.done != total || p.total != total {
+			t.Errorf("progress %d of %d, want %d", p.done, p.total, total)
+		}
+	}
+}
+
+func equalNumbers(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWriteDiffCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	img := image(1024)
+	err := writeDiff(ctx, bytes.NewReader(img), "", "2", 1024, []extent{{0, 1024, true}}, ioutil.Discard, func(uint64, uint64) {})
+	if err != context.Canceled {
+		t.Errorf("error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestWriteExport(t *testing.T) {
+	size := uint64(2*chunkSize + 4096)
+	img := image(int(size))
+	// an allocated chunk which reads as zeros is written as a hole
+	for i := chunkSize; i < 2*chunkSize; i++ {
+		img[i] = 0
+	}
+	list := []extent{{0, 2 * chunkSize, true}, {2 * chunkSize, 4096, false}}
+	want := append([]byte{}, img...)
+	for i := 2 * chunkSize; i < len(want); i++ {
+		want[i] = 0
+	}
+
+	// plain writer, holes are written as zeros
+	var out bytes.Buffer
+	p := &tracked{}
+	if err := writeExport(context.Background(), bytes.NewReader(img), size, list, &out, p.update); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Error("exported data differs from image")
+	}
+	if p.done != 2*chunkSize || p.total != 2*chunkSize {
+		t.Errorf("progress %d of %d", p.done, p.total)
+	}
+
+	// file, holes are skipped and the file is extended to the image size
+	f, err := ioutil.TempFile("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := writeExport(context.Background(), bytes.NewReader(img), size, list, f, func(uint64, uint64) {}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("exported file of %d bytes differs from image of %d bytes", len(got), len(want))
+	}
+}
@@ -0,0 +1,117 @@
+package ceph
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// ErrClosed is returned by Acquire after the manager is closed
+var ErrClosed = errors.New("ceph connection manager is closed")
+
+// Manager keeps a long lived connection to a cluster which is shared by all users.
+// The connection is checked periodically, a broken one is replaced and shut down
+// once the last user releases it
+type Manager struct {
+	opts    Options
+	mutex   sync.Mutex
+	current *lease
+	closed  bool
+}
+
+// lease counts the users of a connection
+type lease struct {
+	handler *CephHandler
+	users   int
+	stale   bool
+}
+
+func NewManager(opts Options) *Manager {
+	return &Manager{opts: opts}
+}
+
+// Acquire returns the handler of the shared connection, connecting if there is no healthy one.
+// release must be called when the handler is not used any more
+func (m *Manager) Acquire() (*CephHandler, func(), error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return nil, nil, ErrClosed
+	}
+	if m.current == nil {
+		handler, err := NewCephHandler(m.opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		m.current = &lease{handler: handler}
+	}
+	l := m.current
+	l.users++
+	var once sync.Once
+	release := func() {
+		once.Do(func() { m.release(l) })
+	}
+	return l.handler, release, nil
+}
+
+func (m *Manager) release(l *lease) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	l.users--
+	if l.stale && l.users == 0 {
+		l.handler.Shutdown()
+	}
+}
+
+// invalidate makes the next Acquire connect again
+func (m *Manager) invalidate(l *lease) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.current != l {
+		return
+	}
+	m.current = nil
+	l.stale = true
+	if l.users == 0 {
+		l.handler.Shutdown()
+	}
+}
+
+// Check asks the monitors for the cluster usage through the shared connection,
+// the connection is replaced if it fails
+func (m *Manager) Check() error {
+	m.mutex.Lock()
+	l := m.current
+	if l != nil {
+		l.users++
+	}
+	m.mutex.Unlock()
+
+	if l != nil {
+		_, err := l.handler.conn.GetClusterStats()
+		m.release(l)
+		if err == nil {
+			return nil
+		}
+		log.Println("Ceph connection is broken, reconnecting:", err)
+		m.invalidate(l)
+	}
+
+	_, release, err := m.Acquire()
+	if err != nil {
+		return err
+	}
+	release()
+	return nil
+}
+
+// Close shuts the connection down once it is released by all users
+func (m *Manager) Close() {
+	m.mutex.Lock()
+	m.closed = true
+	l := m.current
+	m.mutex.Unlock()
+	if l != nil {
+		m.invalidate(l)
+	}
+}
@@ -0,0 +1,127 @@
+package cluster
+
+import (
+	"backup/store"
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Default is the cluster given by configuration, it is used when a task or
+// route does not name a cluster and can not be changed through the registry
+const Default = "default"
+
+var (
+	ErrExists    = errors.New("cluster already exists")
+	ErrImmutable = errors.New("cluster " + Default + " is defined by configuration")
+)
+
+var namePattern = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+type Cluster struct {
+	Name        string `json:"name"`
+	Config      string `json:"config"` // path of ceph.conf
+	Keyring     string `json:"keyring,omitempty"`
+	ClientId    string `json:"client_id"`
+	CreatedTime uint64 `json:"created_time,omitempty"`
+}
+
+func (c *Cluster) Validate() error {
+	if !namePattern.MatchString(c.Name) {
+		return errors.New("name is required and may only contain letters, digits, '_', '.' and '-'")
+	}
+	if c.Config == "" {
+		return errors.New("config is required")
+	}
+	for _, f := range []string{c.Config, c.Keyring} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return err
+		}
+	}
+	if c.ClientId == "" {
+		return errors.New("client_id is required")
+	}
+	return nil
+}
+
+// ClusterHandler keeps the registered clusters, they are stored by name
+type ClusterHandler struct {
+	rh store.Store
+}
+
+func NewClusterHandler(backend store.Backend) *ClusterHandler {
+	rh := backend.Namespace("cluster")
+	return &ClusterHandler{rh}
+}
+
+func (ch *ClusterHandler) AddCluster(c *Cluster) error {
+	if c.Name == Default {
+		return ErrImmutable
+	}
+	ok, err := ch.rh.IsExists(c.Name)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return ErrExists
+	}
+	c.CreatedTime = uint64(time.Now().Unix())
+	return ch.rh.Add(c, c.Name)
+}
+
+func (ch *ClusterHandler) LoadCluster(name string) (*Cluster, error) {
+	bs, err := ch.rh.Load(name)
+	if err != nil {
+		return &Cluster{}, err
+	}
+	c := Cluster{}
+	err = json.Unmarshal(bs, &c)
+	if err != nil {
+		return &Cluster{}, err
+	}
+	return &c, nil
+}
+
+func (ch *ClusterHandler) UpdateCluster(c *Cluster) error {
+	if c.Name == Default {
+		return ErrImmutable
+	}
+	return ch.rh.Update(c, c.Name)
+}
+
+func (ch *ClusterHandler) ListCluster() ([]Cluster, error) {
+	list, err := ch.rh.List()
+	if err != nil {
+		return []Cluster{}, err
+	}
+
+	clusters := make([]Cluster, 0)
+	for _, s := range list {
+		c := Cluster{}
+		err := json.Unmarshal([]byte(s), &c)
+		if err != nil {
+			continue
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, nil
+}
+
+func (ch *ClusterHandler) RemoveCluster(name string) error {
+	if name == Default {
+		return ErrImmutable
+	}
+	return ch.rh.Delete(name)
+}
+
+func (ch *ClusterHandler) IsExists(name string) (bool, error) {
+	if name == Default {
+		return true, nil
+	}
+	return ch.rh.IsExists(name)
+}
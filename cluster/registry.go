@@ -0,0 +1,100 @@
+package cluster
+
+import (
+	"backup/ceph"
+	"log"
+	"sync"
+	"time"
+)
+
+// Registry keeps a connection manager for the default cluster and for every
+// registered cluster in use
+type Registry struct {
+	ch       *ClusterHandler
+	defaults ceph.Options
+	mutex    sync.Mutex
+	managers map[string]*ceph.Manager
+}
+
+// NewRegistry creates the registry, defaults are the options of the default cluster,
+// other clusters share its rbd binary and timeout
+func NewRegistry(ch *ClusterHandler, defaults ceph.Options) *Registry {
+	return &Registry{ch: ch, defaults: defaults, managers: make(map[string]*ceph.Manager)}
+}
+
+// Manager returns the connection manager of cluster name, the default cluster if name is empty
+func (r *Registry) Manager(name string) (*ceph.Manager, error) {
+	if name == "" {
+		name = Default
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if m, ok := r.managers[name]; ok {
+		return m, nil
+	}
+
+	opts := r.defaults
+	if name != Default {
+		c, err := r.ch.LoadCluster(name)
+		if err != nil {
+			return nil, err
+		}
+		opts.ConfigFile = c.Config
+		opts.Keyring = c.Keyring
+		opts.ClientId = c.ClientId
+	}
+	m := ceph.NewManager(opts)
+	r.managers[name] = m
+	return m, nil
+}
+
+// Forget drops the connection to a cluster which is changed or removed,
+// it is shut down once released by all users
+func (r *Registry) Forget(name string) {
+	r.mutex.Lock()
+	m, ok := r.managers[name]
+	delete(r.managers, name)
+	r.mutex.Unlock()
+	if ok {
+		m.Close()
+	}
+}
+
+// Run checks the connections in use every interval until stop is closed
+func (r *Registry) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	unhealthy := make(map[string]bool)
+	for {
+		select {
+		case <-ticker.C:
+			r.mutex.Lock()
+			managers := make(map[string]*ceph.Manager, len(r.managers))
+			for name, m := range r.managers {
+				managers[name] = m
+			}
+			r.mutex.Unlock()
+
+			for name, m := range managers {
+				err := m.Check()
+				if err != nil && !unhealthy[name] {
+					log.Println("Ceph cluster", name, "is unreachable:", err)
+				} else if err == nil && unhealthy[name] {
+					log.Println("Ceph cluster", name, "is reachable again")
+				}
+				unhealthy[name] = err != nil
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (r *Registry) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for name, m := range r.managers {
+		m.Close()
+		delete(r.managers, name)
+	}
+}
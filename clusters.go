@@ -0,0 +1,183 @@
+package main
+
+import (
+	"backup/cluster"
+	"backup/job"
+	"backup/schedule"
+	"backup/store"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// defaultCluster describes the cluster given by configuration
+func defaultCluster() cluster.Cluster {
+	return cluster.Cluster{
+		Name:     cluster.Default,
+		Config:   cfg.Ceph.Config,
+		Keyring:  cfg.Ceph.Keyring,
+		ClientId: cfg.Ceph.ClientId,
+	}
+}
+
+func GetClusters(w http.ResponseWriter, r *http.Request) {
+	ch := cluster.NewClusterHandler(backend)
+	clusters, err := ch.ListCluster()
+	if err != nil {
+		writeFailure(w, r, "list clusters failed", err)
+		return
+	}
+	json.NewEncoder(w).Encode(append([]cluster.Cluster{defaultCluster()}, clusters...))
+}
+
+func GetCluster(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["cluster"]
+	if name == cluster.Default {
+		json.NewEncoder(w).Encode(defaultCluster())
+		return
+	}
+	ch := cluster.NewClusterHandler(backend)
+	c, err := ch.LoadCluster(name)
+	if err != nil {
+		writeFailure(w, r, "load cluster "+name+" failed", err)
+		return
+	}
+	json.NewEncoder(w).Encode(c)
+}
+
+func CreateCluster(w http.ResponseWriter, r *http.Request) {
+	c := cluster.Cluster{}
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid cluster", err)
+		return
+	}
+	if err := c.Validate(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid cluster", err)
+		return
+	}
+
+	ch := cluster.NewClusterHandler(backend)
+	err = ch.AddCluster(&c)
+	if err != nil {
+		writeFailure(w, r, "add cluster "+c.Name+" failed", err)
+		return
+	}
+	json.NewEncoder(w).Encode(c)
+}
+
+func UpdateCluster(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["cluster"]
+	if name == cluster.Default {
+		writeFailure(w, r, "update cluster "+name+" failed", cluster.ErrImmutable)
+		return
+	}
+	ch := cluster.NewClusterHandler(backend)
+	old, err := ch.LoadCluster(name)
+	if err != nil {
+		writeFailure(w, r, "load cluster "+name+" failed", err)
+		return
+	}
+
+	c := cluster.Cluster{}
+	err = json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid cluster", err)
+		return
+	}
+	c.Name = old.Name
+	c.CreatedTime = old.CreatedTime
+	if err := c.Validate(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid cluster", err)
+		return
+	}
+
+	err = ch.UpdateCluster(&c)
+	if err != nil {
+		writeFailure(w, r, "update cluster "+name+" failed", err)
+		return
+	}
+	// connect again with the new settings
+	clusters.Forget(name)
+	json.NewEncoder(w).Encode(c)
+}
+
+func DeleteCluster(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["cluster"]
+	ch := cluster.NewClusterHandler(backend)
+	ok, err := ch.IsExists(name)
+	if err != nil {
+		writeFailure(w, r, "delete cluster "+name+" failed", err)
+		return
+	}
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "cluster "+name+" is not found", nil)
+		return
+	}
+	if name == cluster.Default {
+		writeFailure(w, r, "delete cluster "+name+" failed", cluster.ErrImmutable)
+		return
+	}
+	if reason, err := clusterInUse(name); err != nil {
+		writeFailure(w, r, "delete cluster "+name+" failed", err)
+		return
+	} else if reason != "" {
+		writeError(w, r, http.StatusConflict, "cluster "+name+" is in use by "+reason, nil)
+		return
+	}
+
+	err = ch.RemoveCluster(name)
+	if err != nil {
+		writeFailure(w, r, "delete cluster "+name+" failed", err)
+		return
+	}
+	clusters.Forget(name)
+}
+
+// checkClusters checks that the clusters a task uses are registered,
+// the error response is sent if one is not
+func checkClusters(w http.ResponseWriter, r *http.Request, task job.Task) bool {
+	ch := cluster.NewClusterHandler(backend)
+	for _, name := range []string{task.ClusterName(), task.DestClusterName()} {
+		ok, err := ch.IsExists(name)
+		if err != nil {
+			writeFailure(w, r, "load cluster "+name+" failed", err)
+			return false
+		}
+		if !ok {
+			writeError(w, r, http.StatusNotFound, "cluster "+name+" is not found", nil)
+			return false
+		}
+	}
+	return true
+}
+
+// clusterInUse tells what keeps a cluster from being removed, jobs which are
+// not done yet or schedules whose task uses it as source or destination
+func clusterInUse(name string) (string, error) {
+	jh := job.NewJobHandler(backend)
+	for _, index := range []string{"cluster", "dest_cluster"} {
+		for _, state := range []string{job.StateQueued, job.StateRunning} {
+			q := store.Query{Filters: map[string]string{index: name, "state": state}, Limit: 1}
+			jobs, _, err := jh.QueryJob(q)
+			if err != nil {
+				return "", err
+			}
+			if len(jobs) > 0 {
+				return "job " + jobs[0].Uuid, nil
+			}
+		}
+	}
+
+	sh := schedule.NewScheduleHandler(backend)
+	schedules, err := sh.ListSchedule()
+	if err != nil {
+		return "", err
+	}
+	for _, s := range schedules {
+		if s.Task.ClusterName() == name || s.Task.DestClusterName() == name {
+			return "schedule " + s.Uuid, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,103 @@
+package compress
+
+import (
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// codecs a backup file can be compressed with, files written by None are the raw rbd stream
+const (
+	None = "none"
+	Gzip = "gzip"
+	Zstd = "zstd"
+	Lz4  = "lz4"
+)
+
+// Codecs lists the known codecs
+var Codecs = []string{None, Gzip, Zstd, Lz4}
+
+// extensions are appended to the name of compressed backup files
+var extensions = map[string]string{
+	Gzip: ".gz",
+	Zstd: ".zst",
+	Lz4:  ".lz4",
+}
+
+// Validate checks the codec is known, empty means it is not chosen
+func Validate(codec string) error {
+	if codec == "" || codec == None {
+		return nil
+	}
+	if _, ok := extensions[codec]; !ok {
+		return errors.New("unknown compression " + codec + ", expect none, gzip, zstd or lz4")
+	}
+	return nil
+}
+
+// Extension returns the suffix of files compressed with codec
+func Extension(codec string) string {
+	return extensions[codec]
+}
+
+// FromPath tells the codec of a backup file by its extension
+func FromPath(path string) string {
+	for codec, ext := range extensions {
+		if strings.HasSuffix(path, ext) {
+			return codec
+		}
+	}
+	return None
+}
+
+// TrimExtension removes the compression extension from the name of a backup file
+func TrimExtension(name string) string {
+	return strings.TrimSuffix(name, Extension(FromPath(name)))
+}
+
+// NewWriter compresses what is written to w, the returned writer
+// must be closed to flush it but w is left open
+func NewWriter(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case "", None:
+		return nopCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	case Lz4:
+		return lz4.NewWriter(w), nil
+	}
+	return nil, Validate(codec)
+}
+
+// NewReader decompresses what is read from r, closing the returned reader leaves r open
+func NewReader(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case "", None:
+		return ioutil.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case Lz4:
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	}
+	return nil, Validate(codec)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,95 @@
+package compress
+
+import (
+	"backup/crypt"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+	// images are mostly zeros, holes and repeated blocks
+	sparse := append(make([]byte, 4<<20), bytes.Repeat([]byte("rbd diff v1\n"), 1<<16)...)
+
+	for _, codec := range append(Codecs, "") {
+		for name, b := range map[string][]byte{"empty": nil, "random": random, "sparse": sparse} {
+			var buf bytes.Buffer
+			w, err := NewWriter(codec, &buf)
+			if err != nil {
+				t.Fatalf("%s: %v", codec, err)
+			}
+			if _, err := w.Write(b); err != nil {
+				t.Fatalf("%s %s: %v", codec, name, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("%s %s: %v", codec, name, err)
+			}
+			if name == "sparse" && (codec == None || codec == "") != (buf.Len() == len(b)) {
+				t.Errorf("%s: %d bytes written as %d", codec, len(b), buf.Len())
+			}
+
+			r, err := NewReader(codec, &buf)
+			if err != nil {
+				t.Fatalf("%s %s: %v", codec, name, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Errorf("%s %s: %v", codec, name, err)
+			} else if !bytes.Equal(got, b) {
+				t.Errorf("%s %s: read %d bytes differing from the %d written", codec, name, len(got), len(b))
+			}
+		}
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	if err := Validate("xz"); err == nil {
+		t.Error("xz is valid")
+	}
+	if _, err := NewWriter("xz", ioutil.Discard); err == nil {
+		t.Error("writer of xz")
+	}
+	if _, err := NewReader("xz", bytes.NewReader(nil)); err == nil {
+		t.Error("reader of xz")
+	}
+}
+
+func TestExtension(t *testing.T) {
+	tests := []struct {
+		name    string
+		codec   string
+		trimmed string
+	}{
+		{"default/rbd/img@1", None, "default/rbd/img@1"},
+		{"default/rbd/img@1.gz", Gzip, "default/rbd/img@1"},
+		{"default/rbd/img@1.zst", Zstd, "default/rbd/img@1"},
+		{"default/rbd/img@1.lz4", Lz4, "default/rbd/img@1"},
+		{"default/rbd/img@1-2.diff.zst", Zstd, "default/rbd/img@1-2.diff"},
+		{"default/rbd/img.zst@1", None, "default/rbd/img.zst@1"},
+		// the encryption extension comes last, it is trimmed before the compression one
+		{"x.zst.enc", None, "x.zst.enc"},
+	}
+	for _, test := range tests {
+		if codec := FromPath(test.name); codec != test.codec {
+			t.Errorf("%s: codec %s, want %s", test.name, codec, test.codec)
+		}
+		if trimmed := TrimExtension(test.name); trimmed != test.trimmed {
+			t.Errorf("%s: trimmed %s, want %s", test.name, trimmed, test.trimmed)
+		}
+		if test.codec != None && test.trimmed+Extension(test.codec) != test.name {
+			t.Errorf("%s: extension %s", test.name, Extension(test.codec))
+		}
+	}
+
+	name := "x" + Extension(Zstd) + crypt.Extension
+	if codec := FromPath(crypt.TrimExtension(name)); codec != Zstd {
+		t.Errorf("%s: codec %s once decrypted", name, codec)
+	}
+	if trimmed := TrimExtension(crypt.TrimExtension(name)); trimmed != "x" {
+		t.Errorf("%s: trimmed %s once decrypted", name, trimmed)
+	}
+}
@@ -0,0 +1,275 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+type Config struct {
+	Listen     string           `yaml:"listen"`
+	TLS        TLSConfig        `yaml:"tls"`
+	Store      StoreConfig      `yaml:"store"`
+	Ceph       CephConfig       `yaml:"ceph"`
+	Workers    WorkerConfig     `yaml:"workers"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+	LogLevel   string           `yaml:"log_level"`
+}
+
+// TLSConfig enables https when both certificate and key are set
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+type StoreConfig struct {
+	Type  string      `yaml:"type"` // redis, bolt or memory
+	Redis RedisConfig `yaml:"redis"`
+	Bolt  BoltConfig  `yaml:"bolt"`
+}
+
+type RedisConfig struct {
+	Address        string         `yaml:"address"`
+	Password       string         `yaml:"password"`
+	Database       int            `yaml:"database"`
+	TLS            RedisTLSConfig `yaml:"tls"`
+	PoolSize       int            `yaml:"pool_size"` // maximum connections, 0 means unlimited
+	MaxIdle        int            `yaml:"max_idle"`
+	IdleTimeout    time.Duration  `yaml:"idle_timeout"`
+	ConnectTimeout time.Duration  `yaml:"connect_timeout"`
+	ReadTimeout    time.Duration  `yaml:"read_timeout"`
+	WriteTimeout   time.Duration  `yaml:"write_timeout"`
+	Sentinel       SentinelConfig `yaml:"sentinel"`
+}
+
+type RedisTLSConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	SkipVerify bool `yaml:"skip_verify"`
+}
+
+// SentinelConfig looks the master up through sentinels, address of redis is ignored then
+type SentinelConfig struct {
+	Addresses []string `yaml:"addresses"`
+	Master    string   `yaml:"master"`
+}
+
+type BoltConfig struct {
+	Path string `yaml:"path"`
+}
+
+type CephConfig struct {
+	Config         string        `yaml:"config"` // ceph.conf, the default search path is used if empty
+	Keyring        string        `yaml:"keyring"`
+	ClientId       string        `yaml:"client_id"`
+	RbdPath        string        `yaml:"rbd_path"`
+	Timeout        time.Duration `yaml:"timeout"`         // of monitor and osd operations, 0 means never
+	HealthInterval time.Duration `yaml:"health_interval"` // how often the connection is checked
+}
+
+// EncryptionConfig enables encrypted repositories, the keystore file keeps the master keys
+// and is created with a new key if it does not exist
+type EncryptionConfig struct {
+	Keystore string `yaml:"keystore"`
+}
+
+// WorkerConfig limits running jobs, zero means unlimited
+type WorkerConfig struct {
+	Count   int `yaml:"count"`
+	PerPool int `yaml:"per_pool"`
+	PerRepo int `yaml:"per_repo"`
+}
+
+func Default() *Config {
+	return &Config{
+		Listen: ":8000",
+		Store: StoreConfig{
+			Type: "redis",
+			Redis: RedisConfig{
+				Address:        "127.0.0.1:6379",
+				PoolSize:       32,
+				MaxIdle:        8,
+				IdleTimeout:    5 * time.Minute,
+				ConnectTimeout: 5 * time.Second,
+				ReadTimeout:    10 * time.Second,
+				WriteTimeout:   10 * time.Second,
+			},
+			Bolt: BoltConfig{Path: "backup.db"},
+		},
+		Ceph: CephConfig{
+			ClientId:       "admin",
+			RbdPath:        "/usr/bin/rbd",
+			Timeout:        30 * time.Second,
+			HealthInterval: 30 * time.Second,
+		},
+		Workers:  WorkerConfig{Count: 4},
+		LogLevel: "info",
+	}
+}
+
+// setting is an option which can be overridden by a flag and an environment variable
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	field func(c *Config) interface{} // pointer to string, int or bool field
+}
+
+var settings = []setting{
+	{"listen", "BACKUP_LISTEN", "address to listen on", func(c *Config) interface{} { return &c.Listen }},
+	{"tls-cert", "BACKUP_TLS_CERT", "TLS certificate file", func(c *Config) interface{} { return &c.TLS.Cert }},
+	{"tls-key", "BACKUP_TLS_KEY", "TLS key file", func(c *Config) interface{} { return &c.TLS.Key }},
+	{"store", "BACKUP_STORE", "metadata store: redis, bolt or memory", func(c *Config) interface{} { return &c.Store.Type }},
+	{"redis", "BACKUP_REDIS_ADDRESS", "address of redis server", func(c *Config) interface{} { return &c.Store.Redis.Address }},
+	{"redis-password", "BACKUP_REDIS_PASSWORD", "password of redis server", func(c *Config) interface{} { return &c.Store.Redis.Password }},
+	{"redis-db", "BACKUP_REDIS_DB", "database number of redis server", func(c *Config) interface{} { return &c.Store.Redis.Database }},
+	{"redis-tls", "BACKUP_REDIS_TLS", "connect to redis server over TLS", func(c *Config) interface{} { return &c.Store.Redis.TLS.Enabled }},
+	{"redis-pool-size", "BACKUP_REDIS_POOL_SIZE", "maximum number of redis connections, 0 means unlimited", func(c *Config) interface{} { return &c.Store.Redis.PoolSize }},
+	{"bolt", "BACKUP_BOLT_PATH", "path of bolt database file", func(c *Config) interface{} { return &c.Store.Bolt.Path }},
+	{"ceph-config", "BACKUP_CEPH_CONFIG", "path of ceph.conf", func(c *Config) interface{} { return &c.Ceph.Config }},
+	{"ceph-keyring", "BACKUP_CEPH_KEYRING", "path of ceph keyring", func(c *Config) interface{} { return &c.Ceph.Keyring }},
+	{"ceph-client-id", "BACKUP_CEPH_CLIENT_ID", "ceph client id, without the client. prefix", func(c *Config) interface{} { return &c.Ceph.ClientId }},
+	{"rbd", "BACKUP_RBD_PATH", "path of rbd binary", func(c *Config) interface{} { return &c.Ceph.RbdPath }},
+	{"workers", "BACKUP_WORKERS", "maximum number of jobs running at the same time, 0 means unlimited", func(c *Config) interface{} { return &c.Workers.Count }},
+	{"pool-limit", "BACKUP_POOL_LIMIT", "maximum number of running jobs per pool, 0 means unlimited", func(c *Config) interface{} { return &c.Workers.PerPool }},
+	{"repo-limit", "BACKUP_REPO_LIMIT", "maximum number of running jobs per repository, 0 means unlimited", func(c *Config) interface{} { return &c.Workers.PerRepo }},
+	{"keystore", "BACKUP_KEYSTORE", "path of the keystore file of encryption master keys", func(c *Config) interface{} { return &c.Encryption.Keystore }},
+	{"log-level", "BACKUP_LOG_LEVEL", "log level: debug or info", func(c *Config) interface{} { return &c.LogLevel }},
+}
+
+func set(field interface{}, value string) error {
+	switch p := field.(type) {
+	case *string:
+		*p = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*p = b
+	}
+	return nil
+}
+
+// Load builds the configuration from defaults, the configuration file given by
+// -config or BACKUP_CONFIG, environment variables and flags, in increasing priority
+func Load(name string, args []string) (*Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("BACKUP_CONFIG"), "path of YAML configuration file")
+	values := make(map[string]*string)
+	for _, s := range settings {
+		values[s.flag] = fs.String(s.flag, "", s.usage+", overrides "+s.env)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	if *path != "" {
+		b, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(b, c); err != nil {
+			return nil, errors.New("parse " + *path + " failed: " + err.Error())
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			if err := set(s.field(c), v); err != nil {
+				return nil, errors.New("invalid " + s.env + ": " + err.Error())
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if e := set(s.field(c), *values[s.flag]); e != nil {
+					err = errors.New("invalid -" + s.flag + ": " + e.Error())
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks the configuration before anything is started
+func (c *Config) Validate() error {
+	if c.Listen == "" {
+		return errors.New("listen address is required")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("both tls cert and key are required to enable TLS")
+	}
+	for _, f := range []string{c.TLS.Cert, c.TLS.Key, c.Ceph.Config, c.Ceph.Keyring} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return err
+		}
+	}
+
+	switch c.Store.Type {
+	case "redis":
+		r := c.Store.Redis
+		if r.Address == "" && len(r.Sentinel.Addresses) == 0 {
+			return errors.New("redis address is required")
+		}
+		if len(r.Sentinel.Addresses) > 0 && r.Sentinel.Master == "" {
+			return errors.New("redis sentinel master name is required")
+		}
+		if r.Database < 0 || r.PoolSize < 0 || r.MaxIdle < 0 {
+			return errors.New("redis database and pool sizes can not be negative")
+		}
+	case "bolt":
+		if c.Store.Bolt.Path == "" {
+			return errors.New("bolt path is required")
+		}
+	case "memory":
+	default:
+		return errors.New("unknown store type " + c.Store.Type)
+	}
+
+	info, err := os.Stat(c.Ceph.RbdPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return errors.New(c.Ceph.RbdPath + " is not executable")
+	}
+	if c.Ceph.ClientId == "" {
+		return errors.New("ceph client id is required")
+	}
+	if c.Ceph.Timeout < 0 || c.Ceph.HealthInterval <= 0 {
+		return errors.New("ceph timeout can not be negative and health interval must be positive")
+	}
+
+	if c.Workers.Count < 0 || c.Workers.PerPool < 0 || c.Workers.PerRepo < 0 {
+		return errors.New("worker limits can not be negative")
+	}
+	if c.LogLevel != "debug" && c.LogLevel != "info" {
+		return errors.New("unknown log level " + c.LogLevel)
+	}
+	return nil
+}
+
+// TLSEnabled tells whether the service is served over https
+func (c *Config) TLSEnabled() bool {
+	return c.TLS.Cert != "" && c.TLS.Key != ""
+}
@@ -0,0 +1,327 @@
+package crypt
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extension is appended to the name of encrypted backup files
+const Extension = ".enc"
+
+// Files start with a fixed size header: magic, version, chunk size, the id of the master
+// key and the data key wrapped by it. The data follows in chunks sealed by AES-GCM with the
+// data key, the nonce is the chunk number and the last chunk is marked so that a truncated
+// file is detected. Only the key part of the header changes when the master key is rotated.
+const (
+	magic     = "RBDBKENC"
+	version   = 1
+	chunkSize = 64 << 10
+	maxKeyId  = 64
+	// wrapped data key: nonce, key and tag
+	wrappedSize = 12 + KeySize + 16
+	prefixSize  = len(magic) + 1 + 4
+	// HeaderSize is the size of the header at the start of encrypted files
+	HeaderSize = prefixSize + 1 + maxKeyId + wrappedSize
+)
+
+var (
+	ErrNotEncrypted   = errors.New("file is not encrypted by backup")
+	ErrAuthentication = errors.New("message authentication failed, the file is corrupted, truncated or encrypted by another key")
+	ErrTruncated      = errors.New("encrypted file is truncated")
+)
+
+// TrimExtension removes the encryption extension from the name of a backup file
+func TrimExtension(name string) string {
+	return strings.TrimSuffix(name, Extension)
+}
+
+// IsEncrypted tells whether a backup file is encrypted by its extension
+func IsEncrypted(path string) bool {
+	return strings.HasSuffix(path, Extension)
+}
+
+type header struct {
+	chunkSize uint32
+	keyId     string
+	wrapped   []byte
+}
+
+func (h *header) marshal() []byte {
+	b := make([]byte, HeaderSize)
+	copy(b, magic)
+	b[len(magic)] = version
+	binary.BigEndian.PutUint32(b[len(magic)+1:], h.chunkSize)
+	b[prefixSize] = byte(len(h.keyId))
+	copy(b[prefixSize+1:], h.keyId)
+	copy(b[prefixSize+1+maxKeyId:], h.wrapped)
+	return b
+}
+
+func parseHeader(b []byte) (*header, error) {
+	if len(b) < HeaderSize || string(b[:len(magic)]) != magic {
+		return nil, ErrNotEncrypted
+	}
+	if b[len(magic)] != version {
+		return nil, errors.New("unknown version of encrypted file")
+	}
+	h := &header{chunkSize: binary.BigEndian.Uint32(b[len(magic)+1:])}
+	n := int(b[prefixSize])
+	if h.chunkSize == 0 || n == 0 || n > maxKeyId {
+		return nil, ErrNotEncrypted
+	}
+	h.keyId = string(b[prefixSize+1 : prefixSize+1+n])
+	h.wrapped = append([]byte{}, b[prefixSize+1+maxKeyId:HeaderSize]...)
+	return h, nil
+}
+
+// sealer seals and opens the chunks of a file
+type sealer struct {
+	aead   cipher.AEAD
+	prefix []byte
+	nonce  []byte
+	seq    uint64
+}
+
+func newSealer(dataKey []byte, h *header) (*sealer, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead, prefix: h.marshal()[:prefixSize], nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+// next returns the nonce and additional data of the next chunk
+func (s *sealer) next(final bool) ([]byte, []byte) {
+	binary.BigEndian.PutUint64(s.nonce[len(s.nonce)-8:], s.seq)
+	s.seq++
+	ad := append([]byte{}, s.prefix...)
+	if final {
+		return s.nonce, append(ad, 1)
+	}
+	return s.nonce, append(ad, 0)
+}
+
+type writer struct {
+	w      io.Writer
+	s      *sealer
+	buffer []byte
+	size   int
+	closed bool
+}
+
+// NewWriter encrypts what is written to w with a new data key wrapped by the current
+// master key of ks. The returned writer must be closed to write the last chunk but w is left open.
+func NewWriter(w io.Writer, ks *Keystore) (io.WriteCloser, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	id, wrapped, err := ks.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	h := &header{chunkSize: chunkSize, keyId: id, wrapped: wrapped}
+	s, err := newSealer(dataKey, h)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(h.marshal()); err != nil {
+		return nil, err
+	}
+	return &writer{w: w, s: s, buffer: make([]byte, 0, chunkSize+s.aead.Overhead()), size: chunkSize}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data comes, the last one is sealed by Close
+		if len(w.buffer) == w.size {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := w.size - len(w.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buffer = append(w.buffer, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *writer) seal(final bool) error {
+	nonce, ad := w.s.next(final)
+	sealed := w.s.aead.Seal(w.buffer[:0], nonce, w.buffer, ad)
+	w.buffer = w.buffer[:0]
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+type reader struct {
+	r      *bufio.Reader
+	s      *sealer
+	buffer []byte
+	plain  []byte
+	done   bool
+}
+
+// NewReader decrypts what is read from r, the master key the file was encrypted with must be in ks
+func NewReader(r io.Reader, ks *Keystore) (io.Reader, error) {
+	b := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+	h, err := parseHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := ks.unwrap(h.keyId, h.wrapped)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSealer(dataKey, h)
+	if err != nil {
+		return nil, err
+	}
+	size := int(h.chunkSize) + s.aead.Overhead()
+	return &reader{r: bufio.NewReaderSize(r, size), s: s, buffer: make([]byte, size)}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// open reads and authenticates the next chunk, a chunk shorter than the others
+// or followed by the end of file is the last one
+func (r *reader) open() error {
+	n, err := io.ReadFull(r.r, r.buffer)
+	final := false
+	switch err {
+	case nil:
+		_, err := r.r.Peek(1)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		final = err == io.EOF
+	case io.ErrUnexpectedEOF:
+		final = true
+	case io.EOF:
+		return ErrTruncated
+	default:
+		return err
+	}
+
+	nonce, ad := r.s.next(final)
+	plain, err := r.s.aead.Open(r.buffer[:0], nonce, r.buffer[:n], ad)
+	if err != nil {
+		return ErrAuthentication
+	}
+	r.plain = plain
+	r.done = final
+	return nil
+}
+
+// Rewrap wraps the data key of the file at path again with the current master key of ks,
+// the data is left untouched. The file is copied aside with the new header and renamed
+// over the old one, so that neither its readers nor a crash see it half written.
+// It returns false if the current key is already used.
+func Rewrap(path string, ks *Keystore) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	b := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return false, ErrNotEncrypted
+	}
+	b, ok, err := RewrapHeader(b, ks)
+	if err != nil || !ok {
+		return false, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	err = tmp.Chmod(info.Mode().Perm())
+	if err == nil {
+		_, err = tmp.Write(b)
+	}
+	if err == nil {
+		_, err = io.Copy(tmp, f)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
+
+// RewrapHeader returns the header of an encrypted file with its data key wrapped again
+// with the current master key of ks, and false if the current key is already used
+func RewrapHeader(b []byte, ks *Keystore) ([]byte, bool, error) {
+	h, err := parseHeader(b)
+	if err != nil {
+		return nil, false, err
+	}
+	current, _, err := ks.master("")
+	if err != nil {
+		return nil, false, err
+	}
+	if h.keyId == current {
+		return b, false, nil
+	}
+	dataKey, err := ks.unwrap(h.keyId, h.wrapped)
+	if err != nil {
+		return nil, false, err
+	}
+	h.keyId, h.wrapped, err = ks.wrap(dataKey)
+	if err != nil {
+		return nil, false, err
+	}
+	return h.marshal(), true, nil
+}
@@ -0,0 +1,227 @@
+package crypt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openKeystore(t *testing.T) (*Keystore, string) {
+	dir, err := ioutil.TempDir("", "crypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ks, err := OpenKeystore(filepath.Join(dir, "keystore.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks, dir
+}
+
+func data(size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(b)
+	return b
+}
+
+func encrypt(t *testing.T, ks *Keystore, plain []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := NewWriter(&out, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func decrypt(ks *Keystore, b []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(b), ks)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func keyId(t *testing.T, b []byte) string {
+	t.Helper()
+	h, err := parseHeader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.keyId
+}
+
+func TestRoundTrip(t *testing.T) {
+	ks, _ := openKeystore(t)
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 100} {
+		plain := data(size)
+		sealed := encrypt(t, ks, plain)
+		got, err := decrypt(ks, sealed)
+		if err != nil {
+			t.Errorf("%d bytes: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: decrypted data differs", size)
+		}
+	}
+}
+
+func TestTampered(t *testing.T) {
+	ks, _ := openKeystore(t)
+	sealed := encrypt(t, ks, data(2*chunkSize+10))
+	overhead := len(sealed) - HeaderSize - (2*chunkSize + 10)
+	chunk := chunkSize + overhead/3
+
+	flipped := append([]byte{}, sealed...)
+	flipped[HeaderSize+chunk+1] ^= 1
+	tests := []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"flipped bit", flipped, ErrAuthentication},
+		// a file cut at a chunk boundary ends with a chunk not marked as the last one
+		{"last chunk dropped", sealed[:HeaderSize+2*chunk], ErrAuthentication},
+		{"cut in a chunk", sealed[:HeaderSize+chunk+100], ErrAuthentication},
+		{"header only", sealed[:HeaderSize], ErrTruncated},
+		{"short header", sealed[:HeaderSize-1], ErrNotEncrypted},
+		{"plain file", data(HeaderSize + 100), ErrNotEncrypted},
+	}
+	for _, test := range tests {
+		if _, err := decrypt(ks, test.b); err != test.want {
+			t.Errorf("%s: %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	other, _ := openKeystore(t)
+	if _, err := decrypt(other, sealed); err != ErrUnknownKey {
+		t.Errorf("other keystore: %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	ks, dir := openKeystore(t)
+	plain := data(chunkSize + 10)
+	sealed := encrypt(t, ks, plain)
+	old := keyId(t, sealed)
+
+	key, err := ks.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Id == old || !key.Current {
+		t.Fatalf("rotated to %+v from %s", key, old)
+	}
+	if keys := ks.Keys(); len(keys) != 2 || keys[0].Current || !keys[1].Current {
+		t.Errorf("keys after rotation %+v", keys)
+	}
+
+	// files of the old key are still read, new ones use the current key
+	if got, err := decrypt(ks, sealed); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("file of the old key: %v", err)
+	}
+	if id := keyId(t, encrypt(t, ks, plain)); id != key.Id {
+		t.Errorf("new file wrapped by %s, want %s", id, key.Id)
+	}
+
+	// the keys are kept across restarts
+	reopened, err := OpenKeystore(filepath.Join(dir, "keystore.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := decrypt(reopened, sealed); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("reopened keystore: %v", err)
+	}
+
+	header, changed, err := RewrapHeader(sealed[:HeaderSize], ks)
+	if err != nil || !changed {
+		t.Fatalf("rewrap header: %v %v", changed, err)
+	}
+	if id := keyId(t, header); id != key.Id {
+		t.Errorf("header wrapped by %s, want %s", id, key.Id)
+	}
+	if !bytes.Equal(header[:prefixSize], sealed[:prefixSize]) {
+		t.Error("rewrap changed more than the key")
+	}
+	rewrapped := append(header, sealed[HeaderSize:]...)
+	if got, err := decrypt(ks, rewrapped); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("rewrapped file: %v", err)
+	}
+	if _, changed, err := RewrapHeader(header, ks); changed || err != nil {
+		t.Errorf("rewrap of a current header: %v %v", changed, err)
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	ks, dir := openKeystore(t)
+	plain := data(3 * chunkSize)
+	path := filepath.Join(dir, "img@1"+Extension)
+	if err := ioutil.WriteFile(path, encrypt(t, ks, plain), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reader of the file keeps reading the file it opened
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	changed, err := Rewrap(path, ks)
+	if err != nil || !changed {
+		t.Fatalf("rewrap: %v %v", changed, err)
+	}
+	r, err := NewReader(f, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("file opened before rewrap: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := decrypt(ks, b); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("rewrapped file: %v", err)
+	}
+	current := ks.Keys()[1].Id
+	if id := keyId(t, b); id != current {
+		t.Errorf("file wrapped by %s, want %s", id, current)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("mode of rewrapped file: %v %v", info.Mode(), err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("%d files left in directory, want the keystore and the backup", len(files))
+	}
+
+	if changed, err := Rewrap(path, ks); changed || err != nil {
+		t.Errorf("second rewrap: %v %v", changed, err)
+	}
+	plainPath := filepath.Join(dir, "img@2")
+	if err := ioutil.WriteFile(plainPath, plain, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Rewrap(plainPath, ks); err != ErrNotEncrypted {
+		t.Errorf("rewrap of plain file: %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package crypt
+
+import (
+	"backup/utils"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// KeySize is the size of master and data keys, they are AES-256 keys
+const KeySize = 32
+
+var ErrUnknownKey = errors.New("master key is not in the keystore")
+
+// Key is a master key, the key material is kept base64 encoded in the keystore file
+type Key struct {
+	Id          string `json:"id"`
+	Key         []byte `json:"key"`
+	CreatedTime uint64 `json:"created_time"`
+}
+
+// KeyInfo describes a master key without its material
+type KeyInfo struct {
+	Id          string `json:"id"`
+	CreatedTime uint64 `json:"created_time"`
+	Current     bool   `json:"current"`
+}
+
+// keystoreFile is the content of the keystore file, new data keys are wrapped by
+// the current master key and the others are kept to unwrap the existing ones
+type keystoreFile struct {
+	Current string `json:"current"`
+	Keys    []Key  `json:"keys"`
+}
+
+// Keystore keeps the master keys in a local file which may be written by hand
+// or generated on first use
+type Keystore struct {
+	path  string
+	mutex sync.Mutex
+	file  keystoreFile
+}
+
+// OpenKeystore loads the keystore file at path, it is created with a new
+// master key if it does not exist
+func OpenKeystore(path string) (*Keystore, error) {
+	ks := &Keystore{path: path}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Println("Keystore", path, "does not exist, generate a master key")
+		if _, err := ks.Rotate(); err != nil {
+			return nil, err
+		}
+		return ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &ks.file); err != nil {
+		return nil, errors.New("parse keystore " + path + " failed: " + err.Error())
+	}
+	found := false
+	for _, k := range ks.file.Keys {
+		if len(k.Key) != KeySize || len(k.Id) == 0 || len(k.Id) > maxKeyId {
+			return nil, errors.New("key " + k.Id + " of keystore " + path + " is invalid")
+		}
+		found = found || k.Id == ks.file.Current
+	}
+	if !found {
+		return nil, errors.New("current key " + ks.file.Current + " is not in keystore " + path)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Println("Keystore", path, "is accessible by other users")
+	}
+	return ks, nil
+}
+
+// Keys lists the master keys, oldest first
+func (ks *Keystore) Keys() []KeyInfo {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	infos := make([]KeyInfo, 0, len(ks.file.Keys))
+	for _, k := range ks.file.Keys {
+		infos = append(infos, KeyInfo{k.Id, k.CreatedTime, k.Id == ks.file.Current})
+	}
+	return infos
+}
+
+// Rotate generates a master key which wraps the data keys from now on,
+// the previous keys are kept to read the existing files
+func (ks *Keystore) Rotate() (KeyInfo, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return KeyInfo{}, err
+	}
+	id, err := utils.MakeUuid()
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	created := uint64(time.Now().Unix())
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	file := keystoreFile{Current: id, Keys: append(ks.file.Keys, Key{id, key, created})}
+	if err := save(ks.path, &file); err != nil {
+		return KeyInfo{}, err
+	}
+	ks.file = file
+	return KeyInfo{id, created, true}, nil
+}
+
+// save replaces the keystore file, it is written aside and renamed so that
+// the keys are never lost half written
+func save(path string, file *keystoreFile) error {
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// master returns the AEAD of master key id, the current one if id is empty
+func (ks *Keystore) master(id string) (string, cipher.AEAD, error) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	if id == "" {
+		id = ks.file.Current
+	}
+	for _, k := range ks.file.Keys {
+		if k.Id == id {
+			aead, err := newAEAD(k.Key)
+			return id, aead, err
+		}
+	}
+	return "", nil, ErrUnknownKey
+}
+
+// wrap encrypts a data key with the current master key, the key id is authenticated along
+func (ks *Keystore) wrap(dataKey []byte) (string, []byte, error) {
+	id, aead, err := ks.master("")
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, err
+	}
+	return id, aead.Seal(nonce, nonce, dataKey, []byte(id)), nil
+}
+
+func (ks *Keystore) unwrap(id string, wrapped []byte) ([]byte, error) {
+	_, aead, err := ks.master(id)
+	if err != nil {
+		return nil, err
+	}
+	n := aead.NonceSize()
+	if len(wrapped) < n {
+		return nil, ErrAuthentication
+	}
+	dataKey, err := aead.Open(nil, wrapped[:n], wrapped[n:], []byte(id))
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return dataKey, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
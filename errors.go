@@ -0,0 +1,108 @@
+package main
+
+import (
+	"backup/ceph"
+	"backup/cluster"
+	"backup/job"
+	"backup/store"
+	"backup/utils"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// APIError is the body of every error response
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   string `json:"details,omitempty"`
+	RequestId string `json:"request_id,omitempty"`
+}
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:          "bad_request",
+	http.StatusNotFound:            "not_found",
+	http.StatusMethodNotAllowed:    "method_not_allowed",
+	http.StatusConflict:            "conflict",
+	http.StatusInternalServerError: "internal_error",
+	http.StatusServiceUnavailable:  "unavailable",
+}
+
+// unavailableError marks the failure to reach the ceph cluster
+type unavailableError struct {
+	error
+}
+
+type requestIdKey struct{}
+
+// withRequestId gives every request an id, taken from the X-Request-Id header
+// if the client sends one, and returns it in the same header
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-Id")
+		if id == "" {
+			id, _ = utils.MakeUuid()
+		}
+		w.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
+
+func requestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+// writeError sends the error envelope with status, err is reported as details
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string, err error) {
+	e := APIError{Code: errorCodes[status], Message: message, RequestId: requestId(r)}
+	if e.Code == "" {
+		e.Code = "error"
+	}
+	if err != nil {
+		e.Details = err.Error()
+	}
+	log.Println("Request", e.RequestId, r.Method, r.URL.Path, "failed:", message, e.Details)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// writeFailure sends the error envelope with the status telling what kind of error err is
+func writeFailure(w http.ResponseWriter, r *http.Request, message string, err error) {
+	writeError(w, r, errorStatus(err), message, err)
+}
+
+// writeInvalid is writeFailure for errors caused by the request, they are
+// reported as bad request unless err tells otherwise
+func writeInvalid(w http.ResponseWriter, r *http.Request, message string, err error) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		status = http.StatusBadRequest
+	}
+	writeError(w, r, status, message, err)
+}
+
+func errorStatus(err error) int {
+	if _, ok := err.(unavailableError); ok {
+		return http.StatusServiceUnavailable
+	}
+	switch {
+	case err == store.ErrNotFound || ceph.IsNotFound(err):
+		return http.StatusNotFound
+	case err == job.ErrNotCancellable || err == cluster.ErrExists || err == cluster.ErrImmutable:
+		return http.StatusConflict
+	case store.IsUnavailable(err):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, "no such route", nil)
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, "method "+r.Method+" is not allowed", nil)
+}
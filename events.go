@@ -0,0 +1,167 @@
+package main
+
+import (
+	"backup/job"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+// interval of the comments sent to keep idle streams open
+const heartbeatInterval = 15 * time.Second
+
+// errDone ends a stream right after its first events
+var errDone = errors.New("stream is done")
+
+// writeEvent writes an event in the format of Server-Sent Events
+func writeEvent(w http.ResponseWriter, name string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, b)
+	w.(http.Flusher).Flush()
+	return err
+}
+
+// streamEvents sends the events written by first and then the job events accepted
+// by filter, until the client goes away or filter tells the stream is over. events
+// must be subscribed before the state written by first is loaded so that no change
+// is missed in between.
+func streamEvents(w http.ResponseWriter, r *http.Request, events <-chan job.Event, first func() error, filter func(job.Event) (bool, bool)) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if first != nil {
+		if err := first(); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			send, last := filter(e)
+			if send {
+				if err := writeEvent(w, e.Type, e); err != nil {
+					return
+				}
+			}
+			if last {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// subscribe starts receiving the job events of a stream until stop is closed
+func subscribe(w http.ResponseWriter, r *http.Request, stop <-chan struct{}) (<-chan job.Event, bool) {
+	if _, ok := w.(http.Flusher); !ok {
+		writeError(w, r, http.StatusInternalServerError, "streaming is not supported", nil)
+		return nil, false
+	}
+	jh := job.NewJobHandler(backend)
+	events, err := jh.Subscribe(stop)
+	if err != nil {
+		writeFailure(w, r, "subscribe job events failed", err)
+		return nil, false
+	}
+	return events, true
+}
+
+// GetJobsEvents streams the state changes and progress of all jobs
+func GetJobsEvents(w http.ResponseWriter, r *http.Request) {
+	stop := make(chan struct{})
+	defer close(stop)
+	events, ok := subscribe(w, r, stop)
+	if !ok {
+		return
+	}
+	streamEvents(w, r, events, nil, func(e job.Event) (bool, bool) {
+		return true, false
+	})
+}
+
+// stateRank orders the states a job goes through
+func stateRank(state string) int {
+	switch state {
+	case job.StateQueued:
+		return 0
+	case job.StateRunning:
+		return 1
+	}
+	return 2
+}
+
+// GetJobEvents streams the state changes and progress of one job,
+// the stream starts with the current state and ends when the job is done
+func GetJobEvents(w http.ResponseWriter, r *http.Request) {
+	stop := make(chan struct{})
+	defer close(stop)
+	events, ok := subscribe(w, r, stop)
+	if !ok {
+		return
+	}
+
+	jh := job.NewJobHandler(backend)
+	uuid := mux.Vars(r)["uuid"]
+	j, err := jh.LoadJob(uuid)
+	if err != nil {
+		writeFailure(w, r, "load job "+uuid+" failed", err)
+		return
+	}
+	progress, err := jh.GetJobProgress(uuid)
+	if err != nil {
+		progress = nil
+	}
+
+	first := func() error {
+		j.Position = runner.Position(uuid)
+		if err := writeEvent(w, job.EventState, job.Event{Type: job.EventState, JobUuid: uuid, Job: j}); err != nil {
+			return err
+		}
+		if progress != nil {
+			if err := writeEvent(w, job.EventProgress, job.Event{Type: job.EventProgress, JobUuid: uuid, Progress: progress}); err != nil {
+				return err
+			}
+		}
+		if j.IsDone() {
+			return errDone
+		}
+		return nil
+	}
+	streamEvents(w, r, events, first, func(e job.Event) (bool, bool) {
+		if e.JobUuid != uuid {
+			return false, false
+		}
+		// events received while the job was loaded may be older than what was sent first
+		if e.Type == job.EventState {
+			if stateRank(e.Job.State) <= stateRank(j.State) {
+				return false, false
+			}
+			return true, e.Job.IsDone()
+		}
+		if p := e.Progress; progress != nil && p != nil {
+			if p.UpdatedTime < progress.UpdatedTime || (p.UpdatedTime == progress.UpdatedTime && p.Phase == progress.Phase && p.Bytes < progress.Bytes) {
+				return false, false
+			}
+		}
+		return true, false
+	})
+}
@@ -1,29 +1,89 @@
 package job
 
 import (
-	"backup/redis"
+	"backup/cluster"
+	"backup/compress"
+	"backup/store"
 	"backup/utils"
-	"time"
 	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	StateQueued    = "queued"
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateCancelled = "cancelled"
+)
+
+// transitions lists the states a job is allowed to move to from each state
+var transitions = map[string][]string{
+	StateQueued:  {StateRunning, StateFailed, StateCancelled},
+	StateRunning: {StateSucceeded, StateFailed, StateCancelled},
+}
+
+var taskTypes = []string{"backup", "restore", "incremental-backup", "incremental-restore", "smart-incremental-backup", "point-in-time-restore", "migrate"}
+
+// restoreTypes write into the destination given by RestoreOptions
+var restoreTypes = []string{"restore", "incremental-restore", "point-in-time-restore"}
+
+const (
+	EventState    = "state"
+	EventProgress = "progress"
 )
 
+// Event is published whenever a job changes state or reports progress
+type Event struct {
+	Type     string    `json:"type"`
+	JobUuid  string    `json:"job_uuid"`
+	Job      *Job      `json:"job,omitempty"`
+	Progress *Progress `json:"progress,omitempty"`
+}
+
 type Job struct {
-	Uuid         string  `json:"uuid"`
-	CreatedTime  uint64  `json:"created_time"`
-	Tasks        Task    `json:"task"`
+	Uuid        string `json:"uuid"`
+	CreatedTime uint64 `json:"created_time"`
+	Tasks       Task   `json:"task"`
+	State       string `json:"state"`
+	StartedTime uint64 `json:"started_time,omitempty"`
+	EndedTime   uint64 `json:"ended_time,omitempty"`
+	ExitCode    int    `json:"exit_code"`
+	Error       string `json:"error,omitempty"`
+	Position    int    `json:"queue_position,omitempty"`
 }
 
 type Task struct {
-	Type         string  `json:"type"`
-	Pool         string  `json:"pool"`
-	Image        string  `json:"image"`
-	RepoUuid     string  `json:"repo_uuid"`
-	Incremental  Range   `json:"incremental",omitempty`
+	Type        string         `json:"type"`
+	Cluster     string         `json:"cluster,omitempty"` // the default cluster if empty
+	Pool        string         `json:"pool"`
+	Image       string         `json:"image"`
+	RepoUuid    string         `json:"repo_uuid"`
+	Snapshot    string         `json:"snapshot,omitempty"`
+	Incremental Range          `json:"incremental,omitempty"`
+	BackupUuid  string         `json:"backup_uuid,omitempty"` // catalog entry to restore from
+	Restore     RestoreOptions `json:"restore,omitempty"`
+	Compression string         `json:"compression,omitempty"` // overrides the compression of the repository
+}
+
+const (
+	PolicyRefuse    = "refuse"
+	PolicyOverwrite = "overwrite"
+)
+
+// RestoreOptions tells where an image is restored or migrated, by default it is
+// restored into the cluster, pool and image of the task
+type RestoreOptions struct {
+	DestCluster string `json:"dest_cluster,omitempty"` // the cluster of the task by default
+	DestPool    string `json:"dest_pool,omitempty"`
+	DestImage   string `json:"dest_image,omitempty"`
+	Policy      string `json:"policy,omitempty"` // what to do if the destination exists, refuse by default
 }
 
 type Range struct {
-	Start        string  `json:"start",omitempty`
-	End          string  `json:"end",omitempty`
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
 }
 
 func NewJob(data string) (*Job, error) {
@@ -35,12 +95,127 @@ func NewJob(data string) (*Job, error) {
 	return &job, nil
 }
 
+// Transit moves the job to state and records the start and end time
+func (job *Job) Transit(state string) error {
+	for _, s := range transitions[job.State] {
+		if s != state {
+			continue
+		}
+		job.State = state
+		now := uint64(time.Now().Unix())
+		if state == StateRunning {
+			job.StartedTime = now
+		} else {
+			job.EndedTime = now
+		}
+		return nil
+	}
+	return errors.New("job " + job.Uuid + " can not transit from " + job.State + " to " + state)
+}
+
+func (job *Job) IsDone() bool {
+	return job.State == StateSucceeded || job.State == StateFailed || job.State == StateCancelled
+}
+
+func (task Task) Validate() error {
+	for _, t := range taskTypes {
+		if t == task.Type {
+			if task.Pool == "" || task.Image == "" || task.RepoUuid == "" {
+				return errors.New("pool, image and repo_uuid are required")
+			}
+			if task.Type == "point-in-time-restore" && task.Snapshot == "" {
+				return errors.New("snapshot is required")
+			}
+			if p := task.Restore.Policy; p != "" && p != PolicyRefuse && p != PolicyOverwrite {
+				return errors.New("unknown restore policy " + p)
+			}
+			if task.Restore.Policy != "" && task.Type == "incremental-restore" {
+				return errors.New("policy does not apply to incremental-restore, the diff is applied to the existing image")
+			}
+			if task.Restore.DestCluster != "" && !task.IsRestore() && task.Type != "migrate" {
+				return errors.New("dest_cluster only applies to restore and migrate")
+			}
+			if err := compress.Validate(task.Compression); err != nil {
+				return err
+			}
+			if task.Compression != "" && task.IsRestore() {
+				return errors.New("compression only applies to backups, restores use the one of the backup")
+			}
+			if task.Type == "migrate" && task.DestClusterName() == task.ClusterName() &&
+				task.DestPool() == task.Pool && task.DestImage() == task.Image {
+				return errors.New("migrate requires a destination different from the image")
+			}
+			return nil
+		}
+	}
+	return errors.New("unknown task type " + task.Type)
+}
+
+// ClusterName returns the cluster of the task, jobs created before clusters
+// could be chosen belong to the default cluster
+func (task Task) ClusterName() string {
+	if task.Cluster == "" {
+		return cluster.Default
+	}
+	return task.Cluster
+}
+
+// IsRestore tells whether the task writes into the destination cluster only
+func (task Task) IsRestore() bool {
+	for _, t := range restoreTypes {
+		if t == task.Type {
+			return true
+		}
+	}
+	return false
+}
+
+func (task Task) DestClusterName() string {
+	if task.Restore.DestCluster != "" {
+		return task.Restore.DestCluster
+	}
+	return task.ClusterName()
+}
+
+func (task Task) DestPool() string {
+	if task.Restore.DestPool != "" {
+		return task.Restore.DestPool
+	}
+	return task.Pool
+}
+
+func (task Task) DestImage() string {
+	if task.Restore.DestImage != "" {
+		return task.Restore.DestImage
+	}
+	return task.Image
+}
+
+// Indexes lets jobs be filtered by task type, cluster, destination cluster, pool,
+// image, repository and state
+func (job Job) Indexes() map[string]string {
+	return map[string]string{
+		"type":         job.Tasks.Type,
+		"cluster":      job.Tasks.ClusterName(),
+		"dest_cluster": job.Tasks.DestClusterName(),
+		"pool":         job.Tasks.Pool,
+		"image":        job.Tasks.Image,
+		"repo":         job.Tasks.RepoUuid,
+		"state":        job.State,
+	}
+}
+
+// Score sorts jobs by creation time
+func (job Job) Score() uint64 {
+	return job.CreatedTime
+}
+
 type JobHandler struct {
-	rh *redis.RedisHandler
+	rh store.Store
 }
 
-func NewJobHandler(redisAddress string) *JobHandler{
-	rh := redis.New(redisAddress, "job")
+func NewJobHandler(backend store.Backend) *JobHandler {
+	rh := backend.Namespace("job")
 	return &JobHandler{rh}
 }
 
@@ -51,11 +226,28 @@ func (jh *JobHandler) CreateJob(task Task) (*Job, error) {
 	}
 	timestamp := uint64(time.Now().Unix())
 
-	job := Job{uuid, timestamp, task}
+	job := Job{Uuid: uuid, CreatedTime: timestamp, Tasks: task, State: StateQueued}
 	err = jh.rh.Add(job, uuid)
 	return &job, err
 }
 
+func (jh *JobHandler) LoadJob(uuid string) (*Job, error) {
+	bs, err := jh.rh.Load(uuid)
+	if err != nil {
+		return &Job{}, err
+	}
+	return NewJob(string(bs))
+}
+
+func (jh *JobHandler) UpdateJob(job *Job) error {
+	err := jh.rh.Update(job, job.Uuid)
+	if err != nil {
+		return err
+	}
+	jh.rh.Publish(Event{Type: EventState, JobUuid: job.Uuid, Job: job})
+	return nil
+}
+
 func (jh *JobHandler) ListJob() ([]Job, error) {
 	list, err := jh.rh.List()
 	if err != nil {
@@ -74,11 +266,86 @@ func (jh *JobHandler) ListJob() ([]Job, error) {
 	return jobs, nil
 }
 
-func (jh *JobHandler) GetJobProgress(uuid string) (string, error) {
-	return jh.rh.GetProgress(uuid)
+// QueryJob returns the page of jobs selected by q and the number of all matching jobs,
+// filters are the ones returned by Job.Indexes
+func (jh *JobHandler) QueryJob(q store.Query) ([]Job, int, error) {
+	list, total, err := jh.rh.Query(q)
+	if err != nil {
+		return []Job{}, 0, err
+	}
+
+	jobs := make([]Job, 0, len(list))
+	for _, s := range list {
+		job := Job{}
+		err := json.Unmarshal([]byte(s), &job)
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, total, nil
+}
+
+// Reindex indexes the jobs stored before jobs could be queried or before
+// some of their indexes were added
+func (jh *JobHandler) Reindex() error {
+	names := make([]string, 0)
+	for name := range (Job{}).Indexes() {
+		names = append(names, name)
+	}
+	uuids, err := jh.rh.Unindexed(names...)
+	if err != nil {
+		return err
+	}
+	for _, uuid := range uuids {
+		job, err := jh.LoadJob(uuid)
+		if err != nil {
+			continue
+		}
+		if err := jh.rh.Update(job, uuid); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (jh *JobHandler) UpdateJobProgress(uuid string, percentage int) error {
-	err := jh.rh.UpdateProgress(uuid, percentage)
-	return err
+func (jh *JobHandler) GetJobProgress(uuid string) (*Progress, error) {
+	s, err := jh.rh.GetProgress(uuid)
+	if err != nil {
+		return &Progress{}, err
+	}
+	return parseProgress(s)
+}
+
+func (jh *JobHandler) UpdateJobProgress(uuid string, progress *Progress) error {
+	err := jh.rh.UpdateProgress(uuid, progress)
+	if err != nil {
+		return err
+	}
+	jh.rh.Publish(Event{Type: EventProgress, JobUuid: uuid, Progress: progress})
+	return nil
+}
+
+// Subscribe delivers the state changes and progress of all jobs until stop is closed
+func (jh *JobHandler) Subscribe(stop <-chan struct{}) (<-chan Event, error) {
+	messages, err := jh.rh.Subscribe(stop)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for m := range messages {
+			e := Event{}
+			if err := json.Unmarshal(m, &e); err != nil {
+				continue
+			}
+			select {
+			case events <- e:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return events, nil
 }
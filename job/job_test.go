@@ -0,0 +1,30 @@
+package job
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		task Task
+		ok   bool
+	}{
+		{"backup", Task{Type: "backup", Pool: "rbd", Image: "a", RepoUuid: "r"}, true},
+		{"unknown type", Task{Type: "copy", Pool: "rbd", Image: "a", RepoUuid: "r"}, false},
+		{"no image", Task{Type: "backup", Pool: "rbd", RepoUuid: "r"}, false},
+		{"point in time without snapshot", Task{Type: "point-in-time-restore", Pool: "rbd", Image: "a", RepoUuid: "r"}, false},
+		{"overwrite", Task{Type: "restore", Pool: "rbd", Image: "a", RepoUuid: "r", Restore: RestoreOptions{Policy: PolicyOverwrite}}, true},
+		{"unknown policy", Task{Type: "restore", Pool: "rbd", Image: "a", RepoUuid: "r", Restore: RestoreOptions{Policy: "merge"}}, false},
+		// diffs are applied to the image as it is, there is nothing to overwrite
+		{"incremental restore policy", Task{Type: "incremental-restore", Pool: "rbd", Image: "a", RepoUuid: "r", Restore: RestoreOptions{Policy: PolicyOverwrite}}, false},
+		{"incremental restore", Task{Type: "incremental-restore", Pool: "rbd", Image: "a", RepoUuid: "r"}, true},
+		{"dest cluster of backup", Task{Type: "backup", Pool: "rbd", Image: "a", RepoUuid: "r", Restore: RestoreOptions{DestCluster: "b"}}, false},
+		{"compression of restore", Task{Type: "restore", Pool: "rbd", Image: "a", RepoUuid: "r", Compression: "zstd"}, false},
+		{"migrate onto itself", Task{Type: "migrate", Pool: "rbd", Image: "a", RepoUuid: "r"}, false},
+		{"migrate", Task{Type: "migrate", Pool: "rbd", Image: "a", RepoUuid: "r", Restore: RestoreOptions{DestPool: "ssd"}}, true},
+	}
+	for _, test := range tests {
+		if err := test.task.Validate(); (err == nil) != test.ok {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
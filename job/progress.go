@@ -0,0 +1,140 @@
+package job
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	PhaseSnapshotting = "snapshotting"
+	PhaseExporting    = "exporting"
+	PhaseImporting    = "importing"
+	PhaseVerifying    = "verifying"
+	PhaseDone         = "done"
+)
+
+// progress is saved at most once per saveInterval unless the phase changes
+const saveInterval = time.Second
+
+type Progress struct {
+	Phase       string `json:"phase,omitempty"`
+	Percentage  int    `json:"percentage"`
+	Bytes       uint64 `json:"bytes"`
+	TotalBytes  uint64 `json:"total_bytes"`
+	ImageSize   uint64 `json:"image_size,omitempty"`
+	Throughput  uint64 `json:"throughput"`    // bytes per second
+	Eta         int64  `json:"eta,omitempty"` // seconds
+	UpdatedTime uint64 `json:"updated_time,omitempty"`
+}
+
+// parseProgress accepts the bare percentage saved by older versions as well
+func parseProgress(s string) (*Progress, error) {
+	p := Progress{}
+	if err := json.Unmarshal([]byte(s), &p); err != nil {
+		percentage, err := strconv.Atoi(s)
+		if err != nil {
+			return &Progress{}, err
+		}
+		p.Percentage = percentage
+	}
+	return &p, nil
+}
+
+// Tracker derives throughput and ETA from the bytes an executor reports and saves the progress of a job
+type Tracker struct {
+	jh       *JobHandler
+	uuid     string
+	mutex    sync.Mutex
+	progress Progress
+	sampled  time.Time
+	sampleAt uint64
+	saved    time.Time
+}
+
+func newTracker(jh *JobHandler, uuid string) *Tracker {
+	return &Tracker{jh: jh, uuid: uuid}
+}
+
+// Phase starts a new phase, bytes are counted from zero again
+func (t *Tracker) Phase(phase string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.progress.Phase = phase
+	t.progress.Percentage = 0
+	t.progress.Bytes = 0
+	t.progress.TotalBytes = 0
+	t.progress.Throughput = 0
+	t.progress.Eta = 0
+	t.sampled = time.Now()
+	t.sampleAt = 0
+	t.save()
+}
+
+// SetImageSize records the provisioned size of the image the job works on
+func (t *Tracker) SetImageSize(size uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.progress.ImageSize = size
+}
+
+// Update reports done of total bytes in current phase
+func (t *Tracker) Update(done uint64, total uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	p := &t.progress
+	p.Bytes = done
+	p.TotalBytes = total
+	p.Percentage = 100
+	if total > 0 {
+		p.Percentage = int(done * 100 / total)
+	}
+
+	// throughput is smoothed over samples taken at least a second apart
+	if elapsed := now.Sub(t.sampled); elapsed >= time.Second && done >= t.sampleAt {
+		rate := uint64(float64(done-t.sampleAt) / elapsed.Seconds())
+		if p.Throughput == 0 {
+			p.Throughput = rate
+		} else {
+			p.Throughput = (p.Throughput*7 + rate*3) / 10
+		}
+		t.sampled = now
+		t.sampleAt = done
+	}
+	p.Eta = 0
+	if p.Throughput > 0 && total > done {
+		p.Eta = int64((total - done) / p.Throughput)
+	}
+
+	if now.Sub(t.saved) >= saveInterval || done == total {
+		t.save()
+	}
+}
+
+// finish marks the progress of a succeeded job as complete
+func (t *Tracker) finish() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.progress.Phase = PhaseDone
+	t.progress.Percentage = 100
+	t.progress.Eta = 0
+	t.save()
+}
+
+// flush saves the latest progress of a job which stopped
+func (t *Tracker) flush() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.save()
+}
+
+// save must be called with mutex held
+func (t *Tracker) save() {
+	t.saved = time.Now()
+	t.progress.UpdatedTime = uint64(t.saved.Unix())
+	p := t.progress
+	t.jh.UpdateJobProgress(t.uuid, &p)
+}
@@ -0,0 +1,244 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+)
+
+var (
+	ErrNotCancellable = errors.New("job is not queued or running")
+	ErrRepoBusy       = errors.New("jobs of the repository are running")
+)
+
+// Executor does the actual work of a job and reports its phases and bytes to tracker,
+// it must return as soon as possible once ctx is cancelled
+type Executor func(ctx context.Context, job *Job, tracker *Tracker) error
+
+// exitCoder is implemented by errors which carry the exit code of a process
+type exitCoder interface {
+	ExitStatus() int
+}
+
+// Limits bounds how many jobs run at the same time, zero means unlimited
+type Limits struct {
+	Workers int
+	PerPool int
+	PerRepo int
+}
+
+type pending struct {
+	ctx context.Context
+	job *Job
+}
+
+// Runner executes jobs in background and persists every state change,
+// jobs wait in a queue until the limits allow them to run
+type Runner struct {
+	jh      *JobHandler
+	exec    Executor
+	limits  Limits
+	mutex   sync.Mutex
+	cancels map[string]context.CancelFunc
+	queue   []pending
+	running int
+	pools   map[string]int
+	repos   map[string]int
+	held    map[string]bool // repositories whose jobs are kept queued
+}
+
+func NewRunner(jh *JobHandler, exec Executor, limits Limits) *Runner {
+	return &Runner{
+		jh:      jh,
+		exec:    exec,
+		limits:  limits,
+		cancels: make(map[string]context.CancelFunc),
+		pools:   make(map[string]int),
+		repos:   make(map[string]int),
+		held:    make(map[string]bool),
+	}
+}
+
+// Submit queues a job to be run in background, the job passed in is not modified
+func (r *Runner) Submit(job *Job) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := *job
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cancels[job.Uuid] = cancel
+	r.queue = append(r.queue, pending{ctx, &j})
+	r.dispatch()
+}
+
+// Position returns the 1-based position of a job in queue, 0 if it is not queued
+func (r *Runner) Position(uuid string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, p := range r.queue {
+		if p.job.Uuid == uuid {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// dispatch starts queued jobs in order as long as the limits allow,
+// jobs blocked by a pool or repository limit do not block the jobs behind them.
+// It must be called with mutex held.
+func (r *Runner) dispatch() {
+	queue := make([]pending, 0, len(r.queue))
+	for _, p := range r.queue {
+		task := p.job.Tasks
+		switch {
+		case p.ctx.Err() != nil:
+			go r.run(p.ctx, p.job, false)
+		case r.limits.Workers > 0 && r.running >= r.limits.Workers,
+			r.limits.PerPool > 0 && r.pools[poolKey(task)] >= r.limits.PerPool,
+			r.limits.PerRepo > 0 && r.repos[task.RepoUuid] >= r.limits.PerRepo,
+			r.held[task.RepoUuid]:
+			queue = append(queue, p)
+		default:
+			r.running++
+			r.pools[poolKey(task)]++
+			r.repos[task.RepoUuid]++
+			go r.run(p.ctx, p.job, true)
+		}
+	}
+	r.queue = queue
+}
+
+// poolKey tells pools of the same name in different clusters apart
+func poolKey(task Task) string {
+	return task.ClusterName() + "/" + task.Pool
+}
+
+// release frees the slot taken by a job, counted tells whether it was
+// counted against the limits when it was dispatched
+func (r *Runner) release(job *Job, counted bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cancels[job.Uuid]()
+	delete(r.cancels, job.Uuid)
+
+	task := job.Tasks
+	if counted {
+		r.running--
+		r.pools[poolKey(task)]--
+		r.repos[task.RepoUuid]--
+	}
+	r.dispatch()
+}
+
+// Exclusive runs fn while no job of repository repo runs, the jobs of the repository
+// stay queued until fn returns. It fails with ErrRepoBusy without calling fn if jobs
+// of the repository are running or another fn holds it.
+func (r *Runner) Exclusive(repo string, fn func() error) error {
+	r.mutex.Lock()
+	if r.repos[repo] > 0 || r.held[repo] {
+		r.mutex.Unlock()
+		return ErrRepoBusy
+	}
+	r.held[repo] = true
+	r.mutex.Unlock()
+
+	defer func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		delete(r.held, repo)
+		r.dispatch()
+	}()
+	return fn()
+}
+
+// Cancel stops a job which is not done yet, the executor is interrupted and
+// the job is marked as cancelled once it returns
+func (r *Runner) Cancel(uuid string) error {
+	r.mutex.Lock()
+	cancel, ok := r.cancels[uuid]
+	r.mutex.Unlock()
+	if !ok {
+		return ErrNotCancellable
+	}
+	log.Println("Cancel job", uuid)
+	cancel()
+
+	// drop the job from queue if it is still waiting
+	r.mutex.Lock()
+	r.dispatch()
+	r.mutex.Unlock()
+	return nil
+}
+
+// Recover handles jobs left over by a previous process: queued jobs are
+// submitted again and running jobs are marked as failed
+func (r *Runner) Recover() error {
+	jobs, err := r.jh.ListJob()
+	if err != nil {
+		return err
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		switch job.State {
+		case StateQueued:
+			log.Println("Resubmit queued job", job.Uuid)
+			r.Submit(job)
+		case StateRunning:
+			log.Println("Job", job.Uuid, "was interrupted")
+			job.Error = "interrupted by service restart"
+			job.ExitCode = -1
+			r.transit(job, StateFailed)
+		}
+	}
+	return nil
+}
+
+func (r *Runner) run(ctx context.Context, job *Job, counted bool) {
+	defer r.release(job, counted)
+
+	if ctx.Err() != nil {
+		r.transit(job, StateCancelled)
+		return
+	}
+	if err := r.transit(job, StateRunning); err != nil {
+		return
+	}
+
+	tracker := newTracker(r.jh, job.Uuid)
+	err := r.exec(ctx, job, tracker)
+	if err != nil {
+		tracker.flush()
+	}
+	if err != nil && ctx.Err() != nil {
+		log.Println("Job", job.Uuid, "is cancelled")
+		job.Error = "cancelled"
+		job.ExitCode = -1
+		r.transit(job, StateCancelled)
+		return
+	}
+	if err != nil {
+		log.Println("Job", job.Uuid, "failed:", err)
+		job.Error = err.Error()
+		job.ExitCode = -1
+		if e, ok := err.(exitCoder); ok {
+			job.ExitCode = e.ExitStatus()
+		}
+		r.transit(job, StateFailed)
+		return
+	}
+	tracker.finish()
+	r.transit(job, StateSucceeded)
+}
+
+func (r *Runner) transit(job *Job, state string) error {
+	if err := job.Transit(state); err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := r.jh.UpdateJob(job); err != nil {
+		log.Println("Update job", job.Uuid, "to", state, "failed:", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package job
+
+import (
+	"backup/store"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gate is an executor whose jobs run until they are finished by the test or cancelled
+type gate struct {
+	started chan string
+	mutex   sync.Mutex
+	results map[string]chan error
+}
+
+func newGate() *gate {
+	return &gate{started: make(chan string, 16), results: make(map[string]chan error)}
+}
+
+func (g *gate) result(uuid string) chan error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	c, ok := g.results[uuid]
+	if !ok {
+		c = make(chan error, 1)
+		g.results[uuid] = c
+	}
+	return c
+}
+
+func (g *gate) exec(ctx context.Context, job *Job, tracker *Tracker) error {
+	g.started <- job.Uuid
+	select {
+	case err := <-g.result(job.Uuid):
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *gate) finish(uuid string, err error) {
+	g.result(uuid) <- err
+}
+
+// expectStarted waits until exactly the jobs given are started, in any order
+func (g *gate) expectStarted(t *testing.T, uuids ...string) {
+	t.Helper()
+	started := make([]string, 0, len(uuids))
+	for range uuids {
+		select {
+		case uuid := <-g.started:
+			started = append(started, uuid)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("started %v, want %v", started, uuids)
+		}
+	}
+	want := append([]string{}, uuids...)
+	sort.Strings(started)
+	sort.Strings(want)
+	for i := range want {
+		if started[i] != want[i] {
+			t.Fatalf("started %v, want %v", started, uuids)
+		}
+	}
+	g.expectNoStart(t)
+}
+
+func (g *gate) expectNoStart(t *testing.T) {
+	t.Helper()
+	select {
+	case uuid := <-g.started:
+		t.Fatalf("job %s started", uuid)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type exitError int
+
+func (e exitError) Error() string   { return "exit status" }
+func (e exitError) ExitStatus() int { return int(e) }
+
+func newTestRunner(limits Limits) (*JobHandler, *Runner, *gate) {
+	jh := NewJobHandler(store.NewMemoryBackend())
+	g := newGate()
+	return jh, NewRunner(jh, g.exec, limits), g
+}
+
+func createJob(t *testing.T, jh *JobHandler, task Task) *Job {
+	t.Helper()
+	if task.Type == "" {
+		task.Type = "backup"
+	}
+	job, err := jh.CreateJob(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// waitState waits until the stored job reaches state
+func waitState(t *testing.T, jh *JobHandler, uuid string, state string) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := jh.LoadJob(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State == state {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %s, want %s", uuid, job.State, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransit(t *testing.T) {
+	states := []string{StateQueued, StateRunning, StateSucceeded, StateFailed, StateCancelled}
+	allowed := map[string]bool{
+		StateQueued + ">" + StateRunning:    true,
+		StateQueued + ">" + StateFailed:     true,
+		StateQueued + ">" + StateCancelled:  true,
+		StateRunning + ">" + StateSucceeded: true,
+		StateRunning + ">" + StateFailed:    true,
+		StateRunning + ">" + StateCancelled: true,
+	}
+	for _, from := range states {
+		for _, to := range states {
+			job := &Job{Uuid: "j", State: from}
+			err := job.Transit(to)
+			if allowed[from+">"+to] {
+				if err != nil {
+					t.Errorf("%s to %s: %v", from, to, err)
+				} else if job.State != to {
+					t.Errorf("%s to %s: state is %s", from, to, job.State)
+				}
+				continue
+			}
+			if err == nil {
+				t.Errorf("%s to %s is allowed", from, to)
+			}
+			if job.State != from {
+				t.Errorf("%s to %s: state changed to %s", from, to, job.State)
+			}
+		}
+	}
+}
+
+func TestTransitTimes(t *testing.T) {
+	job := &Job{State: StateQueued}
+	if err := job.Transit(StateRunning); err != nil {
+		t.Fatal(err)
+	}
+	if job.StartedTime == 0 || job.EndedTime != 0 {
+		t.Errorf("running: started %d, ended %d", job.StartedTime, job.EndedTime)
+	}
+	if err := job.Transit(StateSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	if job.EndedTime == 0 {
+		t.Error("ended time is not set")
+	}
+}
+
+func TestRunnerResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		state    string
+		exitCode int
+		message  string
+	}{
+		{"succeeded", nil, StateSucceeded, 0, ""},
+		{"failed", errors.New("no such image"), StateFailed, -1, "no such image"},
+		{"exit code", exitError(2), StateFailed, 2, "exit status"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jh, runner, g := newTestRunner(Limits{})
+			job := createJob(t, jh, Task{Pool: "rbd", Image: "a", RepoUuid: "r"})
+			runner.Submit(job)
+			g.expectStarted(t, job.Uuid)
+			waitState(t, jh, job.Uuid, StateRunning)
+			g.finish(job.Uuid, test.err)
+
+			done := waitState(t, jh, job.Uuid, test.state)
+			if done.ExitCode != test.exitCode || done.Error != test.message {
+				t.Errorf("exit code %d, error %q, want %d, %q", done.ExitCode, done.Error, test.exitCode, test.message)
+			}
+			if done.StartedTime == 0 || done.EndedTime == 0 {
+				t.Errorf("started %d, ended %d", done.StartedTime, done.EndedTime)
+			}
+			if test.err == nil {
+				p, err := jh.GetJobProgress(job.Uuid)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p.Phase != PhaseDone || p.Percentage != 100 {
+					t.Errorf("progress %s %d%%", p.Phase, p.Percentage)
+				}
+			}
+			if err := runner.Cancel(job.Uuid); err != ErrNotCancellable {
+				t.Errorf("cancel done job: %v", err)
+			}
+		})
+	}
+}
+
+func TestCancelRunning(t *testing.T) {
+	jh, runner, g := newTestRunner(Limits{})
+	job := createJob(t, jh, Task{Pool: "rbd", Image: "a", RepoUuid: "r"})
+	runner.Submit(job)
+	g.expectStarted(t, job.Uuid)
+	waitState(t, jh, job.Uuid, StateRunning)
+
+	if err := runner.Cancel(job.Uuid); err != nil {
+		t.Fatal(err)
+	}
+	done := waitState(t, jh, job.Uuid, StateCancelled)
+	if done.Error != "cancelled" || done.ExitCode != -1 {
+		t.Errorf("exit code %d, error %q", done.ExitCode, done.Error)
+	}
+}
+
+func TestCancelQueued(t *testing.T) {
+	jh, runner, g := newTestRunner(Limits{Workers: 1})
+	a := createJob(t, jh, Task{Pool: "rbd", Image: "a", RepoUuid: "r"})
+	b := createJob(t, jh, Task{Pool: "rbd", Image: "b", RepoUuid: "r"})
+	runner.Submit(a)
+	runner.Submit(b)
+	g.expectStarted(t, a.Uuid)
+
+	if err := runner.Cancel(b.Uuid); err != nil {
+		t.Fatal(err)
+	}
+	done := waitState(t, jh, b.Uuid, StateCancelled)
+	if done.StartedTime != 0 {
+		t.Error("cancelled job was started")
+	}
+	if n := runner.Position(b.Uuid); n != 0 {
+		t.Errorf("cancelled job is at %d in queue", n)
+	}
+
+	g.finish(a.Uuid, nil)
+	waitState(t, jh, a.Uuid, StateSucceeded)
+	g.expectNoStart(t)
+}
+
+func TestCancelUnknown(t *testing.T) {
+	_, runner, _ := newTestRunner(Limits{})
+	if err := runner.Cancel("missing"); err != ErrNotCancellable {
+		t.Errorf("cancel unknown job: %v", err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	jh, runner, g := newTestRunner(Limits{})
+	queued := createJob(t, jh, Task{Pool: "rbd", Image: "a", RepoUuid: "r"})
+	running := createJob(t, jh, Task{Pool: "rbd", Image: "b", RepoUuid: "r"})
+	succeeded := createJob(t, jh, Task{Pool: "rbd", Image: "c", RepoUuid: "r"})
+	for _, job := range []*Job{running, succeeded} {
+		job.Transit(StateRunning)
+	}
+	succeeded.Transit(StateSucceeded)
+	for _, job := range []*Job{running, succeeded} {
+		if err := jh.UpdateJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := runner.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	g.expectStarted(t, queued.Uuid)
+
+	failed := waitState(t, jh, running.Uuid, StateFailed)
+	if failed.ExitCode != -1 || failed.Error == "" {
+		t.Errorf("interrupted job: exit code %d, error %q", failed.ExitCode, failed.Error)
+	}
+	g.finish(queued.Uuid, nil)
+	waitState(t, jh, queued.Uuid, StateSucceeded)
+	waitState(t, jh, succeeded.Uuid, StateSucceeded)
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  Limits
+		tasks   []Task
+		started []int // jobs started at once
+		next    int   // job started once the first one is done, -1 if none
+	}{
+		{
+			name:    "unlimited",
+			tasks:   []Task{{Pool: "a", RepoUuid: "r"}, {Pool: "a", RepoUuid: "r"}, {Pool: "a", RepoUuid: "r"}},
+			started: []int{0, 1, 2},
+			next:    -1,
+		},
+		{
+			name:    "workers",
+			limits:  Limits{Workers: 2},
+			tasks:   []Task{{Pool: "a", RepoUuid: "r"}, {Pool: "b", RepoUuid: "s"}, {Pool: "c", RepoUuid: "t"}},
+			started: []int{0, 1},
+			next:    2,
+		},
+		{
+			name:    "per pool",
+			limits:  Limits{PerPool: 1},
+			tasks:   []Task{{Pool: "a", RepoUuid: "r"}, {Pool: "a", RepoUuid: "r"}, {Pool: "b", RepoUuid: "r"}},
+			started: []int{0, 2},
+			next:    1,
+		},
+		{
+			name:    "per pool of each cluster",
+			limits:  Limits{PerPool: 1},
+			tasks:   []Task{{Cluster: "x", Pool: "a", RepoUuid: "r"}, {Cluster: "y", Pool: "a", RepoUuid: "r"}, {Cluster: "x", Pool: "a", RepoUuid: "r"}},
+			started: []int{0, 1},
+			next:    2,
+		},
+		{
+			name:    "per repository",
+			limits:  Limits{PerRepo: 1},
+			tasks:   []Task{{Pool: "a", RepoUuid: "r"}, {Pool: "b", RepoUuid: "r"}, {Pool: "c", RepoUuid: "s"}},
+			started: []int{0, 2},
+			next:    1,
+		},
+		{
+			name:    "workers and per pool",
+			limits:  Limits{Workers: 2, PerPool: 1},
+			tasks:   []Task{{Pool: "a", RepoUuid: "r"}, {Pool: "a", RepoUuid: "r"}, {Pool: "b", RepoUuid: "r"}, {Pool: "c", RepoUuid: "r"}},
+			started: []int{0, 2},
+			next:    1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jh, runner, g := newTestRunner(test.limits)
+			jobs := make([]*Job, len(test.tasks))
+			for i, task := range test.tasks {
+				task.Image = "img"
+				jobs[i] = createJob(t, jh, task)
+				runner.Submit(jobs[i])
+			}
+			started := make([]string, 0, len(test.started))
+			for _, i := range test.started {
+				started = append(started, jobs[i].Uuid)
+			}
+			g.expectStarted(t, started...)
+
+			g.finish(jobs[0].Uuid, nil)
+			waitState(t, jh, jobs[0].Uuid, StateSucceeded)
+			if test.next < 0 {
+				g.expectNoStart(t)
+			} else {
+				g.expectStarted(t, jobs[test.next].Uuid)
+			}
+			for _, job := range jobs[1:] {
+				runner.Cancel(job.Uuid)
+			}
+		})
+	}
+}
+
+func TestPosition(t *testing.T) {
+	jh, runner, g := newTestRunner(Limits{Workers: 1})
+	jobs := make([]*Job, 3)
+	for i := range jobs {
+		jobs[i] = createJob(t, jh, Task{Pool: "rbd", Image: "img", RepoUuid: "r"})
+		runner.Submit(jobs[i])
+	}
+	g.expectStarted(t, jobs[0].Uuid)
+	for i, want := range []int{0, 1, 2} {
+		if n := runner.Position(jobs[i].Uuid); n != want {
+			t.Errorf("job %d is at %d, want %d", i, n, want)
+		}
+	}
+
+	g.finish(jobs[0].Uuid, nil)
+	g.expectStarted(t, jobs[1].Uuid)
+	for i, want := range []int{0, 0, 1} {
+		if n := runner.Position(jobs[i].Uuid); n != want {
+			t.Errorf("job %d is at %d, want %d", i, n, want)
+		}
+	}
+	if n := runner.Position("missing"); n != 0 {
+		t.Errorf("unknown job is at %d", n)
+	}
+	runner.Cancel(jobs[1].Uuid)
+	runner.Cancel(jobs[2].Uuid)
+}
+
+func TestExclusive(t *testing.T) {
+	jh, runner, g := newTestRunner(Limits{})
+	a := createJob(t, jh, Task{Pool: "rbd", Image: "a", RepoUuid: "r"})
+	runner.Submit(a)
+	g.expectStarted(t, a.Uuid)
+
+	called := false
+	err := runner.Exclusive("r", func() error {
+		called = true
+		return nil
+	})
+	if err != ErrRepoBusy || called {
+		t.Fatalf("exclusive with running job: %v, called %v", err, called)
+	}
+	g.finish(a.Uuid, nil)
+	waitState(t, jh, a.Uuid, StateSucceeded)
+
+	// jobs of the repository submitted meanwhile wait, the others run
+	b := createJob(t, jh, Task{Pool: "rbd", Image: "b", RepoUuid: "r"})
+	c := createJob(t, jh, Task{Pool: "rbd", Image: "c", RepoUuid: "s"})
+	failed := errors.New("prune failed")
+	err = runner.Exclusive("r", func() error {
+		runner.Submit(b)
+		runner.Submit(c)
+		g.expectStarted(t, c.Uuid)
+		if n := runner.Position(b.Uuid); n != 1 {
+			t.Errorf("job of held repository is at %d", n)
+		}
+		if err := runner.Exclusive("r", func() error { return nil }); err != ErrRepoBusy {
+			t.Errorf("nested exclusive: %v", err)
+		}
+		return failed
+	})
+	if err != failed {
+		t.Errorf("exclusive returned %v, want %v", err, failed)
+	}
+	g.expectStarted(t, b.Uuid)
+	g.finish(b.Uuid, nil)
+	g.finish(c.Uuid, nil)
+	waitState(t, jh, b.Uuid, StateSucceeded)
+	waitState(t, jh, c.Uuid, StateSucceeded)
+}
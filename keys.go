@@ -0,0 +1,181 @@
+package main
+
+import (
+	"backup/catalog"
+	"backup/crypt"
+	"backup/job"
+	"backup/repo"
+	"backup/storage"
+	"backup/store"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// rewrapping is set while the backups are wrapped again after a key rotation
+var rewrapping int32
+
+func GetKeys(w http.ResponseWriter, r *http.Request) {
+	if keys == nil {
+		writeError(w, r, http.StatusNotFound, "no keystore is configured", nil)
+		return
+	}
+	json.NewEncoder(w).Encode(keys.Keys())
+}
+
+// RotateKey makes a new master key current and wraps the data keys of the encrypted
+// backups with it in background, the old keys are kept in the keystore
+func RotateKey(w http.ResponseWriter, r *http.Request) {
+	if keys == nil {
+		writeError(w, r, http.StatusNotFound, "no keystore is configured", nil)
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&rewrapping, 0, 1) {
+		writeError(w, r, http.StatusConflict, "backups are still being wrapped with the last key", nil)
+		return
+	}
+	key, err := keys.Rotate()
+	if err != nil {
+		atomic.StoreInt32(&rewrapping, 0)
+		writeFailure(w, r, "rotate master key failed", err)
+		return
+	}
+	log.Println("Rotated master key to", key.Id)
+	go func() {
+		defer atomic.StoreInt32(&rewrapping, 0)
+		rewrapBackups()
+	}()
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(key)
+}
+
+// rewrapBackups wraps the data keys of the encrypted backups in the catalog with the
+// current master key, their checksums are updated as the file headers change. Backups
+// of images with queued or running jobs are skipped, they keep the key they have until
+// the next rotation.
+func rewrapBackups() {
+	ch := catalog.NewCatalogHandler(backend)
+	artifacts, err := ch.ListArtifact()
+	if err != nil {
+		log.Println("List backups to rewrap failed:", err)
+		return
+	}
+
+	rh := repo.NewRepositoryHandler(backend)
+	jh := job.NewJobHandler(backend)
+	rewrapped, skipped, failed := 0, 0, 0
+	for _, a := range artifacts {
+		if !a.Encrypted {
+			continue
+		}
+		busy, err := inUse(jh, &a)
+		if err != nil {
+			log.Println("Rewrap backup", a.Uuid, "failed:", err)
+			failed++
+			continue
+		}
+		if busy {
+			log.Println("Skip rewrapping backup", a.Uuid, "used by jobs")
+			skipped++
+			continue
+		}
+		repository, err := rh.LoadRepo(a.RepoUuid)
+		if err != nil {
+			log.Println("Rewrap backup", a.Uuid, "failed:", err)
+			failed++
+			continue
+		}
+		st, err := repository.Storage()
+		if err != nil {
+			log.Println("Rewrap backup", a.Uuid, "failed:", err)
+			failed++
+			continue
+		}
+		changed, size, checksum, err := rewrap(st, a.File)
+		if err != nil {
+			log.Println("Rewrap backup", a.Uuid, "failed:", err)
+			failed++
+			continue
+		}
+		if !changed {
+			continue
+		}
+		a.Size, a.Checksum = size, checksum
+		if err := ch.UpdateArtifact(&a); err != nil {
+			log.Println("Update checksum of backup", a.Uuid, "failed:", err)
+		}
+		rewrapped++
+	}
+	log.Println("Rewrapped", rewrapped, "backups,", skipped, "skipped,", failed, "failed")
+}
+
+// inUse tells whether queued or running jobs use the backups of the image of an artifact
+func inUse(jh *job.JobHandler, a *catalog.Artifact) (bool, error) {
+	for _, state := range []string{job.StateQueued, job.StateRunning} {
+		q := store.Query{Filters: map[string]string{
+			"repo":    a.RepoUuid,
+			"cluster": a.ClusterName(),
+			"pool":    a.Pool,
+			"image":   a.Image,
+			"state":   state,
+		}, Limit: 1}
+		_, total, err := jh.QueryJob(q)
+		if err != nil {
+			return false, err
+		}
+		if total > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rewrap wraps the data key of an encrypted file again with the current master key and
+// returns its new size and checksum. Local files are copied aside and renamed over, the
+// others are written again through the storage which replaces them once complete.
+// It returns false if the current key is already used.
+func rewrap(st storage.Storage, name string) (bool, uint64, string, error) {
+	if local, ok := st.(storage.Local); ok {
+		path := local.Path(name)
+		changed, err := crypt.Rewrap(path, keys)
+		if err != nil || !changed {
+			return false, 0, "", err
+		}
+		size, checksum, err := catalog.Checksum(path)
+		return true, size, checksum, err
+	}
+
+	r, size, err := st.Open(name)
+	if err != nil {
+		return false, 0, "", err
+	}
+	defer r.Close()
+	header := make([]byte, crypt.HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return false, 0, "", crypt.ErrNotEncrypted
+	}
+	header, changed, err := crypt.RewrapHeader(header, keys)
+	if err != nil || !changed {
+		return false, 0, "", err
+	}
+	f, err := storage.CreateSized(st, name, size)
+	if err != nil {
+		return false, 0, "", err
+	}
+	sum := catalog.NewSummer(f)
+	_, err = sum.Write(header)
+	if err == nil {
+		_, err = io.Copy(sum, r)
+	}
+	if err != nil {
+		f.Abort()
+		return false, 0, "", err
+	}
+	if err := sum.Close(); err != nil {
+		return false, 0, "", err
+	}
+	size, checksum := sum.Sum()
+	return true, size, checksum, nil
+}
@@ -1,63 +1,147 @@
 package main
 
 import (
+	"backup/catalog"
 	"backup/ceph"
-	"backup/repo"
+	"backup/cluster"
+	"backup/compress"
+	"backup/config"
+	"backup/crypt"
 	"backup/job"
+	"backup/redis"
+	"backup/repo"
+	"backup/schedule"
+	"backup/storage"
+	"backup/store"
+	"backup/utils"
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/mux"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
 )
 
-func GetPools(w http.ResponseWriter, r *http.Request) {
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+var cfg *config.Config
+var backend store.Backend
+var runner *job.Runner
+var clusters *cluster.Registry
+var keys *crypt.Keystore // nil if encryption is not configured
 
-	// connect to ceph cluster
-	handler, err := ceph.NewCephHandler()
+// acquireCeph returns the handler of the shared connection to cluster name,
+// release must be called when it is not used any more
+func acquireCeph(name string) (*ceph.CephHandler, func(), error) {
+	m, err := clusters.Manager(name)
 	if err != nil {
-		logger.Println("Rados connect failed:", err)
+		return nil, nil, err
 	}
-	logger.Println("Rados connect successily")
+	ch, release, err := m.Acquire()
+	if err != nil {
+		return nil, nil, unavailableError{err}
+	}
+	return ch, release, nil
+}
+
+// clusterName returns the cluster a route is scoped by, routes without
+// cluster belong to the default cluster
+func clusterName(r *http.Request) string {
+	if name, ok := mux.Vars(r)["cluster"]; ok {
+		return name
+	}
+	return cluster.Default
+}
+
+func GetPools(w http.ResponseWriter, r *http.Request) {
+	// use the shared connection to ceph cluster
+	handler, release, err := acquireCeph(clusterName(r))
+	if err != nil {
+		writeFailure(w, r, "can not use ceph cluster "+clusterName(r), err)
+		return
+	}
+	defer release()
 
 	// list pools
 	pools, err := handler.ListPool()
 	if err != nil {
-		logger.Println("List pool failed:", err)
+		writeFailure(w, r, "list pools failed", err)
+		return
 	}
 	json.NewEncoder(w).Encode(pools)
 }
 
 func GetImages(w http.ResponseWriter, r *http.Request) {
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	q, err := parseQuery(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid query", err)
+		return
+	}
 
-	// connect to ceph cluster
-	handler, err := ceph.NewCephHandler()
+	// use the shared connection to ceph cluster
+	handler, release, err := acquireCeph(clusterName(r))
 	if err != nil {
-		logger.Println("Rados connect failed:", err)
+		writeFailure(w, r, "can not use ceph cluster "+clusterName(r), err)
+		return
 	}
-	logger.Println("Rados connect successily")
+	defer release()
 
 	// Get pool name
 	poolName := mux.Vars(r)["name"]
 
-	// list rbd image in pool
-	images, err := handler.ListImage(poolName)
+	// images are paged by name, only the images of the page are opened
+	names, err := handler.ListImageNames(poolName)
 	if err != nil {
-		logger.Println("List image in pool rbd failed:", err)
+		writeFailure(w, r, "list images of pool "+poolName+" failed", err)
+		return
+	}
+	if q.Desc {
+		sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	} else {
+		sort.Strings(names)
+	}
+	total := len(names)
+	if q.Offset < len(names) {
+		names = names[q.Offset:]
+	} else {
+		names = nil
+	}
+	if q.Limit > 0 && q.Limit < len(names) {
+		names = names[:q.Limit]
 	}
+
+	images := make([]ceph.Image, 0, len(names))
+	for _, name := range names {
+		img, err := handler.LoadImage(poolName, name)
+		if err != nil {
+			continue
+		}
+		images = append(images, *img)
+	}
+	writePage(w, r, q, total)
 	json.NewEncoder(w).Encode(images)
 }
 
 func GetRepos(w http.ResponseWriter, r *http.Request) {
-	rh := repo.NewRepositoryHandler("192.168.15.100:6379")
-	repos, err := rh.ListRepo()
+	q, err := parseQuery(r, "name")
 	if err != nil {
-		log.Println("List Repo failed:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, "invalid query", err)
 		return
 	}
+	rh := repo.NewRepositoryHandler(backend)
+	repos, total, err := rh.QueryRepo(q)
+	if err != nil {
+		writeFailure(w, r, "list repositories failed", err)
+		return
+	}
+	for i := range repos {
+		repos[i] = repos[i].Masked()
+	}
+	writePage(w, r, q, total)
 	json.NewEncoder(w).Encode(repos)
 }
 
@@ -66,126 +150,709 @@ func CreateRepo(w http.ResponseWriter, r *http.Request) {
 	repository := repo.Repository{}
 	err := json.NewDecoder(r.Body).Decode(&repository)
 	if err != nil {
-		log.Println("Add Repo failed:", err)
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "invalid repository", err)
+		return
+	}
+	if repository.Encrypted && keys == nil {
+		writeError(w, r, http.StatusBadRequest, "invalid repository", errors.New("encryption requires a keystore to be configured"))
 		return
 	}
 
-	rh := repo.NewRepositoryHandler("192.168.15.100:6379")
+	rh := repo.NewRepositoryHandler(backend)
 	_, err = rh.AddRepo(&repository)
 	if err != nil {
-		log.Println("Add Repo failed:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeInvalid(w, r, "add repository failed", err)
 		return
 	}
-	json.NewEncoder(w).Encode(repository)
+	json.NewEncoder(w).Encode(repository.Masked())
 }
 
 func DeleteRepo(w http.ResponseWriter, r *http.Request) {
-	rh := repo.NewRepositoryHandler("192.168.15.100:6379")
+	rh := repo.NewRepositoryHandler(backend)
 	// Get pool name
 	uuid := mux.Vars(r)["uuid"]
-	err := rh.RemoveRepo(uuid)
+	ok, err := rh.IsExists(uuid)
 	if err != nil {
-		log.Println("Delete Repo failed:", err)
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		writeFailure(w, r, "delete repository "+uuid+" failed", err)
+		return
+	}
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "repository "+uuid+" is not found", nil)
+		return
+	}
+	err = rh.RemoveRepo(uuid)
+	if err != nil {
+		writeFailure(w, r, "delete repository "+uuid+" failed", err)
 		return
 	}
 }
 
+// PruneRepo removes the data of a dedup repository no backup refers to anymore,
+// it is refused while jobs of the repository are running and the jobs submitted
+// meanwhile wait until it is done
+func PruneRepo(w http.ResponseWriter, r *http.Request) {
+	rh := repo.NewRepositoryHandler(backend)
+	uuid := mux.Vars(r)["uuid"]
+	repository, err := rh.LoadRepo(uuid)
+	if err == store.ErrNotFound {
+		writeError(w, r, http.StatusNotFound, "repository "+uuid+" is not found", nil)
+		return
+	}
+	if err != nil {
+		writeFailure(w, r, "prune repository "+uuid+" failed", err)
+		return
+	}
+	st, err := repository.Storage()
+	if err != nil {
+		writeFailure(w, r, "prune repository "+uuid+" failed", err)
+		return
+	}
+	pruner, ok := st.(storage.Pruner)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "repository "+uuid+" of type "+repository.TypeName()+" can not be pruned", nil)
+		return
+	}
+
+	var result storage.PruneResult
+	err = runner.Exclusive(uuid, func() error {
+		var err error
+		result, err = pruner.Prune()
+		return err
+	})
+	if err == job.ErrRepoBusy {
+		writeError(w, r, http.StatusConflict, "repository "+uuid+" has running jobs", nil)
+		return
+	}
+	if err != nil {
+		writeFailure(w, r, "prune repository "+uuid+" failed", err)
+		return
+	}
+	log.Println("Pruned repository", uuid, "removed", result.Removed, "chunks of", result.Freed, "bytes")
+	json.NewEncoder(w).Encode(result)
+}
+
 func GetJobs(w http.ResponseWriter, r *http.Request) {
-	jh := job.NewJobHandler("192.168.15.100:6379")
-	jobs, err := jh.ListJob()
+	q, err := parseQuery(r, "type", "cluster", "pool", "image", "repo", "state")
 	if err != nil {
-		log.Println(err)
+		writeError(w, r, http.StatusBadRequest, "invalid query", err)
+		return
 	}
+	// jobs of every cluster are listed unless the route is scoped by cluster
+	if name, ok := mux.Vars(r)["cluster"]; ok {
+		q.Filters["cluster"] = name
+	}
+	jh := job.NewJobHandler(backend)
+	jobs, total, err := jh.QueryJob(q)
+	if err != nil {
+		writeFailure(w, r, "list jobs failed", err)
+		return
+	}
+	for i := range jobs {
+		jobs[i].Position = runner.Position(jobs[i].Uuid)
+	}
+	writePage(w, r, q, total)
 	json.NewEncoder(w).Encode(jobs)
 }
 
+func GetJob(w http.ResponseWriter, r *http.Request) {
+	jh := job.NewJobHandler(backend)
+	// Get job uuid
+	uuid := mux.Vars(r)["uuid"]
+	job, err := jh.LoadJob(uuid)
+	if err != nil {
+		writeFailure(w, r, "load job "+uuid+" failed", err)
+		return
+	}
+	job.Position = runner.Position(uuid)
+	json.NewEncoder(w).Encode(job)
+}
+
 func CreateJob(w http.ResponseWriter, r *http.Request) {
 	task := job.Task{}
 	err := json.NewDecoder(r.Body).Decode(&task)
 	if err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, "invalid task", err)
+		return
+	}
+	if name, ok := mux.Vars(r)["cluster"]; ok {
+		if task.Cluster != "" && task.Cluster != name {
+			writeError(w, r, http.StatusBadRequest, "task of cluster "+task.Cluster+" can not be created in cluster "+name, nil)
+			return
+		}
+		task.Cluster = name
+	}
+	if !checkClusters(w, r, task) {
+		return
+	}
+	if err := resolveBackup(&task); err != nil {
+		writeInvalid(w, r, "resolve backup "+task.BackupUuid+" failed", err)
+		return
+	}
+	if err := task.Validate(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid task", err)
 		return
 	}
 
-	rh := repo.NewRepositoryHandler("192.168.15.100:6379")
-	repository, err := rh.LoadRepo(task.RepoUuid)
+	rh := repo.NewRepositoryHandler(backend)
+	_, err = rh.LoadRepo(task.RepoUuid)
 	if err != nil {
-		log.Println("Loading repo", task.RepoUuid, "failed", err)
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+		writeInvalid(w, r, "load repository "+task.RepoUuid+" failed", err)
 		return
 	}
 
-	jh := job.NewJobHandler("192.168.15.100:6379")
+	jh := job.NewJobHandler(backend)
 	job, err := jh.CreateJob(task)
 	if err != nil {
-		http.Error(w, "Internal Server Error: can not operate redis server", http.StatusInternalServerError)
+		writeFailure(w, r, "create job failed", err)
 		return
 	}
+	runner.Submit(job)
+	job.Position = runner.Position(job.Uuid)
+	json.NewEncoder(w).Encode(job)
+}
 
-	fn := func(progress int) {
-		jh.UpdateJobProgress(job.Uuid, progress)
+func CancelJob(w http.ResponseWriter, r *http.Request) {
+	jh := job.NewJobHandler(backend)
+	// Get job uuid
+	uuid := mux.Vars(r)["uuid"]
+	j, err := jh.LoadJob(uuid)
+	if err != nil {
+		writeFailure(w, r, "load job "+uuid+" failed", err)
+		return
+	}
+	err = runner.Cancel(uuid)
+	if err == job.ErrNotCancellable {
+		writeError(w, r, http.StatusConflict, "job "+uuid+" is "+j.State, err)
+		return
 	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(j)
+}
 
-	ch := ceph.CephHandler{}
+// resolveBackup fills a restore task which refers to a catalog entry
+// with the repository, image and snapshots of the entry
+func resolveBackup(task *job.Task) error {
+	if task.BackupUuid == "" {
+		return nil
+	}
+	ch := catalog.NewCatalogHandler(backend)
+	artifact, err := ch.LoadArtifact(task.BackupUuid)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case task.Type == "restore" && artifact.Type == catalog.TypeFull:
+		task.Snapshot = artifact.ToSnap
+	case task.Type == "incremental-restore" && artifact.Type == catalog.TypeDiff:
+		task.Incremental = job.Range{Start: artifact.FromSnap, End: artifact.ToSnap}
+	default:
+		return errors.New("backup " + artifact.Uuid + " is " + artifact.Type + ", can not be used by " + task.Type)
+	}
+	task.RepoUuid = artifact.RepoUuid
+	if task.Image == "" {
+		task.Image = artifact.Image
+	}
+	return nil
+}
+
+// runTask is the job.Executor which drives rbd for every task type
+func runTask(ctx context.Context, j *job.Job, tracker *job.Tracker) error {
+	task := j.Tasks
+	rh := repo.NewRepositoryHandler(backend)
+	repository, err := rh.LoadRepo(task.RepoUuid)
+	if err != nil {
+		return err
+	}
+
+	// restores only touch the destination cluster
+	name := task.ClusterName()
+	if task.IsRestore() {
+		name = task.DestClusterName()
+	}
+	ch, release, err := acquireCeph(name)
+	if err != nil {
+		return err
+	}
+	defer release()
 	switch task.Type {
 	case "backup":
-		err = ch.Backup(task.Pool, task.Image, repository.Path + "/"  + task.Image, fn)
+		enc, err := encoding(&task, &repository)
 		if err != nil {
-			http.Error(w, "Internal Server Error: backup progress is not executed", http.StatusInternalServerError)
-			return
+			return err
 		}
+		name := repository.FullName(task.ClusterName(), task.Pool, task.Image, task.Snapshot) + enc.Extension()
+		size := startExport(ch, tracker, &task)
+		return writeBackup(j, &repository, catalog.TypeFull, name, size, tracker, func(w io.Writer) error {
+			return ch.Backup(ctx, task.Pool, task.Image, task.Snapshot, w, enc, tracker.Update)
+		})
 	case "restore":
-		err = ch.Restore(task.Pool, repository.Path + "/" + task.Image, fn)
+		name, enc, err := backupFile(&task, &repository, repository.FullName(task.ClusterName(), task.Pool, task.Image, task.Snapshot))
 		if err != nil {
-			http.Error(w, "Internal Server Error: backup progress is not executed", http.StatusInternalServerError)
-			return
+			return err
+		}
+		dest, err := prepareDestination(ch, &task, j.Uuid)
+		if err != nil {
+			return err
 		}
+		tracker.Phase(job.PhaseImporting)
+		return dest.finish(restoreBackup(ctx, ch, &repository, catalog.TypeFull, name, enc, dest.pool, dest.temp, tracker.Update))
 	case "incremental-backup":
 		start := task.Incremental.Start
 		end := task.Incremental.End
-		path := repository.Path + "/" + task.Image + "@" + start + "_to_" + end + ".diff"
-		err = ch.IncrementalBackup(task.Pool, task.Image, path, start, end, fn)
+		enc, err := encoding(&task, &repository)
 		if err != nil {
-			http.Error(w, "Internal Server Error: incremental backup progress is not executed", http.StatusInternalServerError)
-			return
+			return err
 		}
+		name := repository.DiffName(task.ClusterName(), task.Pool, task.Image, start, end) + enc.Extension()
+		size := startExport(ch, tracker, &task)
+		return writeBackup(j, &repository, catalog.TypeDiff, name, size, tracker, func(w io.Writer) error {
+			return ch.IncrementalBackup(ctx, task.Pool, task.Image, w, start, end, enc, tracker.Update)
+		})
 	case "incremental-restore":
 		start := task.Incremental.Start
 		end := task.Incremental.End
-		path := repository.Path + "/" + task.Image + "@" + start + "_to_" + end + ".diff"
-		err = ch.IncrementalRestore(task.Pool, task.Image, path, fn)
+		name, enc, err := backupFile(&task, &repository, repository.DiffName(task.ClusterName(), task.Pool, task.Image, start, end))
 		if err != nil {
-			http.Error(w, "Internal Server Error: incremental restore progress is not executed", http.StatusInternalServerError)
-			return
+			return err
 		}
+		tracker.Phase(job.PhaseImporting)
+		return restoreBackup(ctx, ch, &repository, catalog.TypeDiff, name, enc, task.DestPool(), task.DestImage(), tracker.Update)
+	case "smart-incremental-backup":
+		return smartIncrementalBackup(ctx, ch, j, &repository, tracker)
+	case "point-in-time-restore":
+		return pointInTimeRestore(ctx, ch, j, &repository, tracker)
+	case "migrate":
+		return migrate(ctx, ch, j, &repository, tracker)
+	}
+	return errors.New("unknown task type " + task.Type)
+}
 
+// encoding returns how the files written by the task are compressed and encrypted,
+// the compression of the repository is used unless the task chooses another
+func encoding(task *job.Task, repository *repo.Repository) (ceph.Encoding, error) {
+	enc := ceph.Encoding{Compression: repository.Compression}
+	if task.Compression != "" {
+		enc.Compression = task.Compression
 	}
-	json.NewEncoder(w).Encode(job)
+	if enc.Compression == "" {
+		enc.Compression = compress.None
+	}
+	if repository.Encrypted {
+		if keys == nil {
+			return enc, errors.New("repository " + repository.Uuid + " is encrypted but no keystore is configured")
+		}
+		enc.Keys = keys
+	}
+	if repository.TypeName() == repo.TypeDedup && !enc.Plain() {
+		return enc, errors.New("backups of dedup repository " + repository.Uuid + " can not be compressed")
+	}
+	return enc, nil
+}
+
+// decoding returns how a backup file is read
+func decoding(compression string, encrypted bool) (ceph.Encoding, error) {
+	enc := ceph.Encoding{Compression: compression}
+	if encrypted {
+		if keys == nil {
+			return enc, errors.New("backup is encrypted but no keystore is configured")
+		}
+		enc.Keys = keys
+	}
+	return enc, nil
+}
+
+// findBackup returns the existing file of the backup stored as name with any encoding,
+// the plain one is preferred. Backups written before files were kept under the cluster
+// and pool of their image are found by the base name as well.
+func findBackup(st storage.Storage, name string) (string, error) {
+	var err error
+	for _, n := range []string{name, path.Base(name)} {
+		if _, err = st.Stat(n); !os.IsNotExist(err) {
+			return n, err
+		}
+		for _, c := range compress.Codecs {
+			for _, ext := range []string{compress.Extension(c), compress.Extension(c) + crypt.Extension} {
+				if _, err := st.Stat(n + ext); err == nil {
+					return n + ext, nil
+				}
+			}
+		}
+	}
+	return name, err
+}
+
+// backupFile returns the file of the catalog entry the task refers to, or the file stored
+// as name with any encoding if there is none, along with the encoding of the file
+func backupFile(task *job.Task, repository *repo.Repository, name string) (string, ceph.Encoding, error) {
+	if task.BackupUuid == "" {
+		st, err := repository.Storage()
+		if err != nil {
+			return "", ceph.Encoding{}, err
+		}
+		name, err := findBackup(st, name)
+		if err != nil {
+			return "", ceph.Encoding{}, err
+		}
+		enc, err := decoding(compress.FromPath(crypt.TrimExtension(name)), crypt.IsEncrypted(name))
+		return name, enc, err
+	}
+	// resolveBackup has set the repository of the task to the one of the entry
+	ch := catalog.NewCatalogHandler(backend)
+	artifact, err := ch.LoadArtifact(task.BackupUuid)
+	if err != nil {
+		return "", ceph.Encoding{}, err
+	}
+	enc, err := decoding(artifact.Compression, artifact.Encrypted)
+	return artifact.File, enc, err
+}
+
+// writeBackup stores what write writes as file name of the repository and adds it to
+// the catalog, the file is discarded if the backup fails. size is the size of the image
+// exported, 0 if unknown.
+func writeBackup(j *job.Job, repository *repo.Repository, typ string, name string, size uint64, tracker *job.Tracker, write func(w io.Writer) error) error {
+	st, err := repository.Storage()
+	if err != nil {
+		return err
+	}
+	f, err := storage.CreateSized(st, name, size)
+	if err != nil {
+		return err
+	}
+	sum := catalog.NewSummer(f)
+	if err := write(sum); err != nil {
+		log.Println("Discard partial backup file", name)
+		f.Abort()
+		return err
+	}
+	tracker.Phase(job.PhaseVerifying)
+	if err := sum.Close(); err != nil {
+		return err
+	}
+	return record(j, repository, typ, name, sum)
+}
+
+// restoreBackup imports the full backup, or applies the diff, stored as file name of the
+// repository to the image. Plain local files are read by rbd directly.
+func restoreBackup(ctx context.Context, ch *ceph.CephHandler, repository *repo.Repository, typ string, name string, enc ceph.Encoding, pool string, img string, fn ceph.ProgressFunc) error {
+	st, err := repository.Storage()
+	if err != nil {
+		return err
+	}
+	if local, ok := st.(storage.Local); ok && enc.Plain() {
+		if typ == catalog.TypeDiff {
+			return ch.IncrementalRestoreFile(ctx, pool, img, local.Path(name), fn)
+		}
+		return ch.RestoreFile(ctx, pool, img, local.Path(name), fn)
+	}
+
+	r, size, err := st.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if typ == catalog.TypeDiff {
+		return ch.IncrementalRestore(ctx, pool, img, r, size, enc, fn)
+	}
+	return ch.Restore(ctx, pool, img, r, size, enc, fn)
+}
+
+// startExport enters the exporting phase with the size of the image being exported
+// and returns the size, 0 if it is unknown
+func startExport(ch *ceph.CephHandler, tracker *job.Tracker, task *job.Task) uint64 {
+	size := uint64(0)
+	img, err := ch.LoadImage(task.Pool, task.Image)
+	if err == nil {
+		size = img.Size
+		tracker.SetImageSize(size)
+	}
+	tracker.Phase(job.PhaseExporting)
+	return size
+}
+
+// record adds the file written by a successful backup job to the catalog
+func record(j *job.Job, repository *repo.Repository, typ string, name string, sum catalog.Summer) error {
+	task := j.Tasks
+	artifact := catalog.Artifact{
+		RepoUuid:    repository.Uuid,
+		Cluster:     task.ClusterName(),
+		Pool:        task.Pool,
+		Image:       task.Image,
+		Type:        typ,
+		File:        name,
+		Compression: compress.FromPath(crypt.TrimExtension(name)),
+		Encrypted:   crypt.IsEncrypted(name),
+		JobUuid:     j.Uuid,
+	}
+	if typ == catalog.TypeFull {
+		artifact.ToSnap = task.Snapshot
+	} else {
+		artifact.FromSnap = task.Incremental.Start
+		artifact.ToSnap = task.Incremental.End
+	}
+	artifact.Size, artifact.Checksum = sum.Sum()
+
+	ch := catalog.NewCatalogHandler(backend)
+	_, err := ch.AddArtifact(&artifact)
+	return err
+}
+
+// smartIncrementalBackup takes a new snapshot of the image and exports its difference from
+// the newest snapshot which is in the cluster and can be restored from the catalog of the
+// repository, or the whole snapshot if there is no such base. The snapshots used are recorded in the task of the job.
+func smartIncrementalBackup(ctx context.Context, ch *ceph.CephHandler, j *job.Job, repository *repo.Repository, tracker *job.Tracker) error {
+	task := &j.Tasks
+	enc, err := encoding(task, repository)
+	if err != nil {
+		return err
+	}
+	tracker.Phase(job.PhaseSnapshotting)
+	snap, err := ch.CreateSnapshot(task.Pool, task.Image)
+	if err != nil {
+		return err
+	}
+	task.Snapshot = snap
+	log.Println("Created snapshot", snap, "of image", task.Image, "in pool", task.Pool)
+
+	snaps, err := ch.ListSnapshot(task.Pool, task.Image)
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool)
+	for _, s := range snaps {
+		exists[strconv.Itoa(s.Timestamp)] = true
+	}
+	cat := catalog.NewCatalogHandler(backend)
+	artifacts, err := cat.ListByImage(task.ClusterName(), task.Pool, task.Image)
+	if err != nil {
+		return err
+	}
+	backups := make([]catalog.Artifact, 0)
+	for _, a := range artifacts {
+		if a.RepoUuid == repository.Uuid {
+			backups = append(backups, a)
+		}
+	}
+	base := catalog.Base(backups, func(s string) bool {
+		return s != snap && exists[s]
+	})
+
+	if base == "" {
+		log.Println("No base snapshot of image", task.Image, "in repo", repository.Uuid, "take full backup")
+		name := repository.FullName(task.ClusterName(), task.Pool, task.Image, snap) + enc.Extension()
+		size := startExport(ch, tracker, task)
+		return writeBackup(j, repository, catalog.TypeFull, name, size, tracker, func(w io.Writer) error {
+			return ch.Backup(ctx, task.Pool, task.Image, snap, w, enc, tracker.Update)
+		})
+	}
+	task.Incremental = job.Range{Start: base, End: snap}
+	name := repository.DiffName(task.ClusterName(), task.Pool, task.Image, base, snap) + enc.Extension()
+	size := startExport(ch, tracker, task)
+	return writeBackup(j, repository, catalog.TypeDiff, name, size, tracker, func(w io.Writer) error {
+		return ch.IncrementalBackup(ctx, task.Pool, task.Image, w, base, snap, enc, tracker.Update)
+	})
+}
+
+// pointInTimeRestore restores the image to the target snapshot by importing
+// a full backup and then every diff after it in order
+func pointInTimeRestore(ctx context.Context, ch *ceph.CephHandler, j *job.Job, repository *repo.Repository, tracker *job.Tracker) error {
+	task := j.Tasks
+	cat := catalog.NewCatalogHandler(backend)
+	artifacts, err := cat.ListByRepo(repository.Uuid)
+	if err != nil {
+		return err
+	}
+	backups := make([]catalog.Artifact, 0)
+	for _, a := range artifacts {
+		if a.ClusterName() == task.ClusterName() && a.Pool == task.Pool && a.Image == task.Image {
+			backups = append(backups, a)
+		}
+	}
+	chain, err := catalog.Chain(backups, task.Snapshot)
+	if err != nil {
+		return err
+	}
+
+	dest, err := prepareDestination(ch, &task, j.Uuid)
+	if err != nil {
+		return err
+	}
+	return dest.finish(restoreChain(ctx, ch, chain, repository, dest.pool, dest.temp, tracker))
+}
+
+// restoreChain imports the full backup and applies the diffs of chain to the image
+func restoreChain(ctx context.Context, ch *ceph.CephHandler, chain []catalog.Artifact, repository *repo.Repository, pool string, img string, tracker *job.Tracker) error {
+	// progress is counted over the files of the whole chain
+	total := uint64(0)
+	for _, a := range chain {
+		total += a.Size
+	}
+	tracker.Phase(job.PhaseImporting)
+	imported := uint64(0)
+	for _, a := range chain {
+		log.Println("Restore", a.File, "to image", img, "in pool", pool)
+		step := func(done uint64, _ uint64) {
+			tracker.Update(imported+done, total)
+		}
+		enc, err := decoding(a.Compression, a.Encrypted)
+		if err != nil {
+			return err
+		}
+		err = restoreBackup(ctx, ch, repository, a.Type, a.File, enc, pool, img, step)
+		if err != nil {
+			return err
+		}
+		if a.Type == catalog.TypeDiff {
+			imported += a.Size
+			continue
+		}
+		// import-diff requires the start snapshot to exist on the image
+		err = ch.CreateNamedSnapshot(pool, img, a.ToSnap)
+		if err != nil {
+			return err
+		}
+		imported += a.Size
+	}
+	return nil
+}
+
+// migrate copies the image into the destination through the repository: the snapshot of the
+// task, or a new one if there is none, is exported as a full backup and imported into the
+// destination, where the snapshot is created as well so that diffs taken later can be applied.
+// The destination is only checked after the export and replaced once the import succeeded.
+func migrate(ctx context.Context, src *ceph.CephHandler, j *job.Job, repository *repo.Repository, tracker *job.Tracker) error {
+	task := &j.Tasks
+	dest, release, err := acquireCeph(task.DestClusterName())
+	if err != nil {
+		return err
+	}
+	defer release()
+	enc, err := encoding(task, repository)
+	if err != nil {
+		return err
+	}
+
+	if task.Snapshot == "" {
+		tracker.Phase(job.PhaseSnapshotting)
+		snap, err := src.CreateSnapshot(task.Pool, task.Image)
+		if err != nil {
+			return err
+		}
+		task.Snapshot = snap
+		log.Println("Created snapshot", snap, "of image", task.Image, "in pool", task.Pool)
+	}
+
+	name := repository.FullName(task.ClusterName(), task.Pool, task.Image, task.Snapshot) + enc.Extension()
+	size := startExport(src, tracker, task)
+	err = writeBackup(j, repository, catalog.TypeFull, name, size, tracker, func(w io.Writer) error {
+		return src.Backup(ctx, task.Pool, task.Image, task.Snapshot, w, enc, tracker.Update)
+	})
+	if err != nil {
+		return err
+	}
+
+	target, err := prepareDestination(dest, task, j.Uuid)
+	if err != nil {
+		return err
+	}
+	log.Println("Migrate image", task.Image, "to image", target.img, "in pool", target.pool, "of cluster", task.DestClusterName())
+	tracker.Phase(job.PhaseImporting)
+	err = restoreBackup(ctx, dest, repository, catalog.TypeFull, name, enc, target.pool, target.temp, tracker.Update)
+	if err == nil {
+		err = dest.CreateNamedSnapshot(target.pool, target.temp, task.Snapshot)
+	}
+	return target.finish(err)
+}
+
+// destination is the image a restore writes into. An existing image which is
+// overwritten is kept until the restore into a temporary image succeeded.
+type destination struct {
+	ch   *ceph.CephHandler
+	pool string
+	img  string // the image restored
+	temp string // the image imported into, img unless it is overwritten
+}
+
+// prepareDestination applies the restore policy when the destination image exists:
+// the restore is refused, or it is imported into a temporary image named after the job
+func prepareDestination(ch *ceph.CephHandler, task *job.Task, jobUuid string) (*destination, error) {
+	d := &destination{ch: ch, pool: task.DestPool(), img: task.DestImage()}
+	d.temp = d.img
+	_, err := ch.LoadImage(d.pool, d.img)
+	if ceph.IsNotFound(err) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if task.Restore.Policy != job.PolicyOverwrite {
+		return nil, errors.New("image " + d.img + " already exists in pool " + d.pool)
+	}
+	if err := ch.CheckOverwritable(d.pool, d.img); err != nil {
+		return nil, err
+	}
+	d.temp = "." + d.img + "." + jobUuid + ".partial"
+	log.Println("Restore into image", d.temp, "in pool", d.pool, "to overwrite image", d.img)
+	return d, nil
+}
+
+// finish removes the partial image if the restore failed with err, otherwise the
+// temporary image replaces the destination. The destination is checked again as
+// snapshots may have been protected or cloned while restoring.
+func (d *destination) finish(err error) error {
+	if err == nil && d.temp == d.img {
+		return nil
+	}
+	if err == nil {
+		err = d.ch.CheckOverwritable(d.pool, d.img)
+	}
+	if err == nil {
+		log.Println("Replace image", d.img, "in pool", d.pool, "with image", d.temp)
+		if err = d.ch.RemoveImage(d.pool, d.img); ceph.IsNotFound(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		// the image replaced is gone, so the restored one is kept whatever happens
+		if err := d.ch.RenameImage(d.pool, d.temp, d.img); err != nil {
+			log.Println("Rename image", d.temp, "to", d.img, "in pool", d.pool, "failed, the restored image is kept as", d.temp)
+			return errors.New("restored image is kept as " + d.temp + " in pool " + d.pool + ", rename failed: " + err.Error())
+		}
+		return nil
+	}
+
+	log.Println("Remove partial image", d.temp, "in pool", d.pool)
+	if rerr := d.ch.RemoveImage(d.pool, d.temp); rerr != nil && !ceph.IsNotFound(rerr) {
+		log.Println("Remove image", d.temp, "in pool", d.pool, "failed:", rerr)
+	}
+	return err
 }
 
 func GetJobProgress(w http.ResponseWriter, r *http.Request) {
-	jh := job.NewJobHandler("192.168.15.100:6379")
+	jh := job.NewJobHandler(backend)
 	// Get job uuid
 	uuid := mux.Vars(r)["uuid"]
+	if _, err := jh.LoadJob(uuid); err != nil {
+		writeFailure(w, r, "load job "+uuid+" failed", err)
+		return
+	}
 	progress, err := jh.GetJobProgress(uuid)
-	if err != nil {
-		log.Println("Get the progress of repo", uuid, "failed:", err)
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	if err != nil && err != store.ErrNotFound { // a job which has not started has no progress
+		writeFailure(w, r, "get the progress of job "+uuid+" failed", err)
 		return
 	}
-	w.Write([]byte(progress))
+	json.NewEncoder(w).Encode(progress)
 }
 
 func GetSnapshots(w http.ResponseWriter, r *http.Request) {
 
-	handler, err := ceph.NewCephHandler()
+	handler, release, err := acquireCeph(clusterName(r))
 	if err != nil {
-		log.Println("Rados connect failed:", err)
+		writeFailure(w, r, "can not use ceph cluster "+clusterName(r), err)
+		return
 	}
-	log.Println("Rados connect successily")
+	defer release()
 
 	// Get pool and image name
 	poolName := mux.Vars(r)["pool_name"]
@@ -194,65 +861,182 @@ func GetSnapshots(w http.ResponseWriter, r *http.Request) {
 	// list snaps
 	snaps, err := handler.ListSnapshot(poolName, imgName)
 	if err != nil {
-		log.Println("List snapshots of image", imgName, "in pool", poolName, "failed:", err)
+		writeFailure(w, r, "list snapshots of image "+imgName+" in pool "+poolName+" failed", err)
+		return
 	}
 	json.NewEncoder(w).Encode(snaps)
 }
 
 func CreateSnapshot(w http.ResponseWriter, r *http.Request) {
 
-	handler, err := ceph.NewCephHandler()
+	handler, release, err := acquireCeph(clusterName(r))
 	if err != nil {
-		log.Println("Rados connect failed:", err)
+		writeFailure(w, r, "can not use ceph cluster "+clusterName(r), err)
+		return
 	}
-	log.Println("Rados connect successily")
+	defer release()
 
 	// Get pool and image name
 	poolName := mux.Vars(r)["pool_name"]
 	imgName := mux.Vars(r)["img_name"]
 
-	// list snaps
-	err = handler.CreateSnapshot(poolName, imgName)
+	// snapshot is named by current timestamp
+	name, err := handler.CreateSnapshot(poolName, imgName)
 	if err != nil {
-		log.Println("Create snapshot of image", imgName, "in pool", poolName, "failed:", err)
+		writeFailure(w, r, "create snapshot of image "+imgName+" in pool "+poolName+" failed", err)
+		return
 	}
+	timestamp, _ := strconv.Atoi(name)
+	json.NewEncoder(w).Encode(ceph.SnapShot{Timestamp: timestamp})
 }
 
 func DeleteSnapshot(w http.ResponseWriter, r *http.Request) {
 
-	handler, err := ceph.NewCephHandler()
+	handler, release, err := acquireCeph(clusterName(r))
 	if err != nil {
-		log.Println("Rados connect failed:", err)
+		writeFailure(w, r, "can not use ceph cluster "+clusterName(r), err)
+		return
 	}
-	log.Println("Rados connect successily")
+	defer release()
 
 	// Get pool and image name
 	poolName := mux.Vars(r)["pool_name"]
 	imgName := mux.Vars(r)["img_name"]
 	snap_timestamp := mux.Vars(r)["snap_timestamp"]
 
-	// list snaps
-	err = handler.CreateSnapshot(poolName, imgName)
+	err = handler.RemoveSnapshot(poolName, imgName, snap_timestamp)
 	if err != nil {
-		log.Println("Delete snapshot", snap_timestamp, "of image", imgName, "in pool", poolName, "failed:", err)
+		writeFailure(w, r, "delete snapshot "+snap_timestamp+" of image "+imgName+" in pool "+poolName+" failed", err)
+		return
 	}
 }
 
 func main() {
+	var err error
+	cfg, err = config.Load(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatal("Load config failed: ", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal("Invalid config: ", err)
+	}
+	utils.SetLogLevel(cfg.LogLevel)
+
+	r := cfg.Store.Redis
+	backend, err = store.Open(store.Config{
+		Type: cfg.Store.Type,
+		Redis: redis.Config{
+			Address:           r.Address,
+			Password:          r.Password,
+			Database:          r.Database,
+			TLS:               r.TLS.Enabled,
+			TLSSkipVerify:     r.TLS.SkipVerify,
+			MaxIdle:           r.MaxIdle,
+			MaxActive:         r.PoolSize,
+			IdleTimeout:       r.IdleTimeout,
+			ConnectTimeout:    r.ConnectTimeout,
+			ReadTimeout:       r.ReadTimeout,
+			WriteTimeout:      r.WriteTimeout,
+			SentinelAddresses: r.Sentinel.Addresses,
+			SentinelMaster:    r.Sentinel.Master,
+		},
+		BoltPath: cfg.Store.Bolt.Path,
+	})
+	if err != nil {
+		log.Fatal("Open store failed: ", err)
+	}
+	defer backend.Close()
+
+	// a crash in the middle of an update can leave the lists of redis inconsistent
+	if err := store.Repair(backend, "job", "repo", "schedule", "catalog", "cluster"); err != nil {
+		log.Println("Repair store failed:", err)
+	}
+	if err := job.NewJobHandler(backend).Reindex(); err != nil {
+		log.Println("Reindex jobs failed:", err)
+	}
+	if err := repo.NewRepositoryHandler(backend).Reindex(); err != nil {
+		log.Println("Reindex repositories failed:", err)
+	}
+
+	if cfg.Encryption.Keystore != "" {
+		keys, err = crypt.OpenKeystore(cfg.Encryption.Keystore)
+		if err != nil {
+			log.Fatal("Open keystore failed: ", err)
+		}
+	}
+
+	clusters = cluster.NewRegistry(cluster.NewClusterHandler(backend), ceph.Options{
+		ConfigFile: cfg.Ceph.Config,
+		Keyring:    cfg.Ceph.Keyring,
+		ClientId:   cfg.Ceph.ClientId,
+		RbdPath:    cfg.Ceph.RbdPath,
+		Timeout:    cfg.Ceph.Timeout,
+	})
+	defer clusters.Close()
+	if m, err := clusters.Manager(cluster.Default); err == nil {
+		if err := m.Check(); err != nil {
+			log.Println("Ceph cluster", cluster.Default, "is unreachable:", err)
+		}
+	}
+	go clusters.Run(cfg.Ceph.HealthInterval, nil)
+
+	limits := job.Limits{Workers: cfg.Workers.Count, PerPool: cfg.Workers.PerPool, PerRepo: cfg.Workers.PerRepo}
+	runner = job.NewRunner(job.NewJobHandler(backend), runTask, limits)
+	if err := runner.Recover(); err != nil {
+		log.Println("Recover jobs failed:", err)
+	}
+	scheduler := schedule.NewScheduler(schedule.NewScheduleHandler(backend), job.NewJobHandler(backend), runner)
+	go scheduler.Run(30 * time.Second)
+
 	router := mux.NewRouter()
-	router.HandleFunc("/pools", GetPools).Methods("GET")
-	router.HandleFunc("/pools/{name}/images", GetImages).Methods("GET")
+	router.NotFoundHandler = http.HandlerFunc(notFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	router.HandleFunc("/clusters", GetClusters).Methods("GET")
+	router.HandleFunc("/clusters", CreateCluster).Methods("POST")
+	router.HandleFunc("/clusters/{cluster}", GetCluster).Methods("GET")
+	router.HandleFunc("/clusters/{cluster}", UpdateCluster).Methods("PUT")
+	router.HandleFunc("/clusters/{cluster}", DeleteCluster).Methods("DELETE")
+	router.HandleFunc("/clusters/{cluster}/jobs", GetJobs).Methods("GET")
+	router.HandleFunc("/clusters/{cluster}/jobs", CreateJob).Methods("POST")
+
+	// the routes without cluster prefix belong to the default cluster
+	for _, prefix := range []string{"", "/clusters/{cluster}"} {
+		router.HandleFunc(prefix+"/pools", GetPools).Methods("GET")
+		router.HandleFunc(prefix+"/pools/{name}/images", GetImages).Methods("GET")
 
-	router.HandleFunc("/pools/{pool_name}/images/{img_name}/snaps", GetSnapshots).Methods("GET")
-	router.HandleFunc("/pools/{pool_name}/images/{img_name}/snaps/{snap_timestamp}", CreateSnapshot).Methods("POST")
+		router.HandleFunc(prefix+"/pools/{pool_name}/images/{img_name}/snaps", GetSnapshots).Methods("GET")
+		router.HandleFunc(prefix+"/pools/{pool_name}/images/{img_name}/snaps/{snap_timestamp}", CreateSnapshot).Methods("POST")
+		router.HandleFunc(prefix+"/pools/{pool_name}/images/{img_name}/snaps/{snap_timestamp}", DeleteSnapshot).Methods("DELETE")
+		router.HandleFunc(prefix+"/pools/{pool_name}/images/{img_name}/backups", GetImageBackups).Methods("GET")
+	}
 
 	router.HandleFunc("/repos", GetRepos).Methods("GET")
 	router.HandleFunc("/repos", CreateRepo).Methods("POST")
 	router.HandleFunc("/repos/{uuid}", DeleteRepo).Methods("DELETE")
+	router.HandleFunc("/repos/{uuid}/backups", GetRepoBackups).Methods("GET")
+	router.HandleFunc("/repos/{uuid}/prune", PruneRepo).Methods("POST")
+	router.HandleFunc("/backups/{uuid}", GetBackup).Methods("GET")
 	router.HandleFunc("/jobs", GetJobs).Methods("GET")
 	router.HandleFunc("/jobs", CreateJob).Methods("POST")
+	router.HandleFunc("/jobs/events", GetJobsEvents).Methods("GET")
+	router.HandleFunc("/jobs/{uuid}", GetJob).Methods("GET")
+	router.HandleFunc("/jobs/{uuid}/events", GetJobEvents).Methods("GET")
+	router.HandleFunc("/jobs/{uuid}/cancel", CancelJob).Methods("POST")
 	router.HandleFunc("/jobs/{uuid}/progress", GetJobProgress).Methods("GET")
-	log.Fatal(http.ListenAndServe(":8000", router))
+
+	router.HandleFunc("/schedules", GetSchedules).Methods("GET")
+	router.HandleFunc("/schedules", CreateSchedule).Methods("POST")
+	router.HandleFunc("/schedules/{uuid}", GetSchedule).Methods("GET")
+	router.HandleFunc("/schedules/{uuid}", UpdateSchedule).Methods("PUT")
+	router.HandleFunc("/schedules/{uuid}", DeleteSchedule).Methods("DELETE")
+
+	router.HandleFunc("/keys", GetKeys).Methods("GET")
+	router.HandleFunc("/keys/rotate", RotateKey).Methods("POST")
+	log.Println("Listen on", cfg.Listen)
+	if cfg.TLSEnabled() {
+		log.Fatal(http.ListenAndServeTLS(cfg.Listen, cfg.TLS.Cert, cfg.TLS.Key, withRequestId(router)))
+	}
+	log.Fatal(http.ListenAndServe(cfg.Listen, withRequestId(router)))
 
 	/*logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
 
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"backup/store"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// parseQuery reads the page from offset, limit and order of the query string, the
+// created time range from created_after and created_before, and the given filters
+func parseQuery(r *http.Request, filters ...string) (store.Query, error) {
+	values := r.URL.Query()
+	q := store.Query{Filters: make(map[string]string)}
+
+	var err error
+	if q.Offset, err = intParam(values.Get("offset")); err != nil {
+		return q, errors.New("invalid offset")
+	}
+	if q.Limit, err = intParam(values.Get("limit")); err != nil {
+		return q, errors.New("invalid limit")
+	}
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, errors.New("order must be asc or desc")
+	}
+	if q.From, err = timeParam(values.Get("created_after")); err != nil {
+		return q, errors.New("invalid created_after")
+	}
+	if q.To, err = timeParam(values.Get("created_before")); err != nil {
+		return q, errors.New("invalid created_before")
+	}
+	for _, name := range filters {
+		if v := values.Get(name); v != "" {
+			q.Filters[name] = v
+		}
+	}
+	return q, nil
+}
+
+func intParam(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid number " + s)
+	}
+	return n, nil
+}
+
+// timeParam parses a unix timestamp
+func timeParam(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// writePage tells the client the number of all matching elements and
+// links to the neighbouring pages
+func writePage(w http.ResponseWriter, r *http.Request, q store.Query, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if q.Limit == 0 {
+		return
+	}
+
+	link := func(offset int, rel string) string {
+		u := *r.URL
+		values := u.Query()
+		values.Set("offset", strconv.Itoa(offset))
+		values.Set("limit", strconv.Itoa(q.Limit))
+		u.RawQuery = values.Encode()
+		return "<" + u.RequestURI() + ">; rel=\"" + rel + "\""
+	}
+	links := []string{link(0, "first")}
+	if q.Offset > 0 {
+		prev := q.Offset - q.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link(prev, "prev"))
+	}
+	if q.Offset+q.Limit < total {
+		links = append(links, link(q.Offset+q.Limit, "next"))
+		links = append(links, link((total-1)/q.Limit*q.Limit, "last"))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
@@ -0,0 +1,352 @@
+package redis
+
+import (
+	"backup/utils"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+)
+
+// Indexes of a namespace are kept in these keys, ':' keeps them apart from the
+// "<namespace>-<uuid>" keys of elements:
+//   <namespace>:sorted               sorted set of uuids scored by Score()
+//   <namespace>:index:<name>:<value> set of uuids whose index name has value
+//   <namespace>:indexes:<uuid>       the indexRecord of an element
+
+// indexable has the methods of store.Indexable
+type indexable interface {
+	Indexes() map[string]string
+	Score() uint64
+}
+
+// indexRecord remembers the indexes of an element, so they can be removed or
+// rebuilt without decoding the element
+type indexRecord struct {
+	Score   uint64            `json:"score"`
+	Indexes map[string]string `json:"indexes"`
+}
+
+func newIndexRecord(i interface{}) *indexRecord {
+	e, ok := i.(indexable)
+	if !ok {
+		return nil
+	}
+	return &indexRecord{e.Score(), e.Indexes()}
+}
+
+func (h *RedisHandler) sortedKey() string {
+	return h.namespace + ":sorted"
+}
+
+func (h *RedisHandler) indexKey(name string, value string) string {
+	return h.namespace + ":index:" + name + ":" + value
+}
+
+func (h *RedisHandler) recordKey(uuid string) string {
+	return h.namespace + ":indexes:" + uuid
+}
+
+func (h *RedisHandler) loadRecord(client redis.Conn, uuid string) (*indexRecord, error) {
+	b, err := redis.Bytes(client.Do("GET", h.recordKey(uuid)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &indexRecord{}
+	if err := json.Unmarshal(b, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (h *RedisHandler) sendIndex(client redis.Conn, uuid string, record *indexRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	client.Send("SET", h.recordKey(uuid), string(b))
+	client.Send("ZADD", h.sortedKey(), record.Score, uuid)
+	for name, value := range record.Indexes {
+		client.Send("SADD", h.indexKey(name, value), uuid)
+	}
+	return nil
+}
+
+func (h *RedisHandler) sendUnindex(client redis.Conn, uuid string, record *indexRecord) {
+	client.Send("DEL", h.recordKey(uuid))
+	client.Send("ZREM", h.sortedKey(), uuid)
+	for name, value := range record.Indexes {
+		client.Send("SREM", h.indexKey(name, value), uuid)
+	}
+}
+
+// transaction runs the commands sent by fn in MULTI/EXEC together with the ones which
+// move the indexes of uuid from the stored record to record, record is nil to remove them.
+// It starts over if the stored record is changed in the meantime
+func (h *RedisHandler) transaction(client redis.Conn, uuid string, record *indexRecord, fn func()) error {
+	for {
+		if _, err := client.Do("WATCH", h.recordKey(uuid)); err != nil {
+			return err
+		}
+		old, err := h.loadRecord(client, uuid)
+		if err != nil {
+			return err
+		}
+		client.Send("MULTI")
+		fn()
+		if old != nil {
+			h.sendUnindex(client, uuid, old)
+		}
+		if record != nil {
+			if err := h.sendIndex(client, uuid, record); err != nil {
+				return err
+			}
+		}
+		reply, err := client.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			return nil
+		}
+		utils.Debug("Index of", uuid, "in namespace", h.namespace, "changed, retrying")
+	}
+}
+
+// mget loads the elements of uuids, the ones which do not exist are skipped
+func (h *RedisHandler) mget(client redis.Conn, uuids []string) ([]string, error) {
+	list := make([]string, 0, len(uuids))
+	for start := 0; start < len(uuids); start += batchSize {
+		end := start + batchSize
+		if end > len(uuids) {
+			end = len(uuids)
+		}
+		keys := make([]interface{}, 0, end-start)
+		for _, uuid := range uuids[start:end] {
+			keys = append(keys, h.namespace+"-"+uuid)
+		}
+		values, err := redis.Values(client.Do("MGET", keys...))
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			if v == nil { // dangling entry, left to Repair
+				continue
+			}
+			list = append(list, string(v.([]byte)))
+		}
+	}
+	return list, nil
+}
+
+// Query returns the indexed elements whose indexes match filters and whose score is
+// between from and to, 0 means no bound, skipping offset elements and returning at most
+// limit, 0 means no limit. The number of all matching elements is returned as well.
+// Elements with the same score are ordered by uuid
+func (h *RedisHandler) Query(filters map[string]string, from uint64, to uint64, desc bool, offset int, limit int) ([]string, int, error) {
+	client, err := h.connect()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer client.Close()
+
+	min, max := interface{}("-inf"), interface{}("+inf")
+	if from > 0 {
+		min = from
+	}
+	if to > 0 {
+		max = to
+	}
+	count := -1
+	if limit > 0 {
+		count = limit
+	}
+
+	source := h.sortedKey()
+	client.Send("MULTI")
+	if len(filters) > 0 {
+		// intersect the sorted set with the index sets, weight 0 keeps the score of elements
+		id, err := utils.MakeUuid()
+		if err != nil {
+			return nil, 0, err
+		}
+		source = h.namespace + ":query:" + id
+		args := []interface{}{source, len(filters) + 1, h.sortedKey()}
+		weights := []interface{}{"WEIGHTS", 1}
+		for name, value := range filters {
+			args = append(args, h.indexKey(name, value))
+			weights = append(weights, 0)
+		}
+		client.Send("ZINTERSTORE", append(args, weights...)...)
+	}
+	client.Send("ZCOUNT", source, min, max)
+	if desc {
+		client.Send("ZREVRANGEBYSCORE", source, max, min, "LIMIT", offset, count)
+	} else {
+		client.Send("ZRANGEBYSCORE", source, min, max, "LIMIT", offset, count)
+	}
+	if len(filters) > 0 {
+		client.Send("DEL", source)
+	}
+	vs, err := redis.Values(client.Do("EXEC"))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(filters) > 0 {
+		vs = vs[1:]
+	}
+	total, err := redis.Int(vs[0], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	uuids, err := redis.Strings(vs[1], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	list, err := h.mget(client, uuids)
+	return list, total, err
+}
+
+// Unindexed returns the uuids of the elements stored without indexes, such as the
+// ones added before their type was indexable, or without some of the given indexes
+func (h *RedisHandler) Unindexed(names ...string) ([]string, error) {
+	client, err := h.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	uuids, err := redis.Strings(client.Do("LRANGE", h.namespace+"-list", 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	unindexed := make([]string, 0)
+	for start := 0; start < len(uuids); start += batchSize {
+		end := start + batchSize
+		if end > len(uuids) {
+			end = len(uuids)
+		}
+		keys := make([]interface{}, 0, end-start)
+		for _, uuid := range uuids[start:end] {
+			keys = append(keys, h.recordKey(uuid))
+		}
+		values, err := redis.Values(client.Do("MGET", keys...))
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if v == nil || !hasIndexes(v.([]byte), names) {
+				unindexed = append(unindexed, uuids[start+i])
+			}
+		}
+	}
+	return unindexed, nil
+}
+
+func hasIndexes(b []byte, names []string) bool {
+	record := indexRecord{}
+	if err := json.Unmarshal(b, &record); err != nil {
+		return false
+	}
+	for _, name := range names {
+		if _, ok := record.Indexes[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// scan returns the keys matching pattern
+func scan(client redis.Conn, pattern string) ([]string, error) {
+	keys := make([]string, 0)
+	cursor := 0
+	for {
+		vs, err := redis.Values(client.Do("SCAN", cursor, "MATCH", pattern, "COUNT", batchSize))
+		if err != nil {
+			return nil, err
+		}
+		cursor, err = redis.Int(vs[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		ks, err := redis.Strings(vs[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, ks...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// repairIndexes drops the indexes of elements which do not exist, rebuilds the indexes
+// of the existing ones from their records and removes stale entries of index sets
+func (h *RedisHandler) repairIndexes(client redis.Conn, elements map[string]bool) error {
+	prefix := h.namespace + ":indexes:"
+	keys, err := scan(client, prefix+"*")
+	if err != nil {
+		return err
+	}
+	records := make(map[string]*indexRecord)
+	for _, key := range keys {
+		uuid := strings.TrimPrefix(key, prefix)
+		record, err := h.loadRecord(client, uuid)
+		if err != nil || record == nil {
+			continue
+		}
+		if !elements[uuid] {
+			utils.Debug("Removing indexes of", uuid, "from namespace", h.namespace)
+			h.sendUnindex(client, uuid, record)
+			continue
+		}
+		records[uuid] = record
+		if err := h.sendIndex(client, uuid, record); err != nil {
+			return err
+		}
+	}
+	// receive the replies of the commands sent above
+	if _, err := client.Do(""); err != nil {
+		return err
+	}
+
+	uuids, err := redis.Strings(client.Do("ZRANGE", h.sortedKey(), 0, -1))
+	if err != nil {
+		return err
+	}
+	for _, uuid := range uuids {
+		if records[uuid] == nil {
+			if _, err := client.Do("ZREM", h.sortedKey(), uuid); err != nil {
+				return err
+			}
+		}
+	}
+
+	prefix = h.namespace + ":index:"
+	keys, err = scan(client, prefix+"*")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		r := strings.SplitN(strings.TrimPrefix(key, prefix), ":", 2)
+		if len(r) != 2 {
+			continue
+		}
+		members, err := redis.Strings(client.Do("SMEMBERS", key))
+		if err != nil {
+			return err
+		}
+		for _, uuid := range members {
+			record := records[uuid]
+			if record != nil && record.Indexes[r[0]] == r[1] {
+				continue
+			}
+			if _, err := client.Do("SREM", key, uuid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package redis
+
+import (
+	"backup/utils"
+	"crypto/tls"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Config tells how to reach redis, the master is looked up through
+// sentinels if SentinelAddresses is not empty and Address is ignored
+type Config struct {
+	Address           string
+	Password          string
+	Database          int
+	TLS               bool
+	TLSSkipVerify     bool
+	MaxIdle           int
+	MaxActive         int // 0 means unlimited
+	IdleTimeout       time.Duration
+	ConnectTimeout    time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	SentinelAddresses []string
+	SentinelMaster    string
+}
+
+// ErrNoMaster is returned when none of the sentinels knows the master
+var ErrNoMaster = errors.New("no sentinel knows the redis master")
+
+// NewPool creates the connection pool shared by the handlers of every namespace
+func NewPool(c Config) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     c.MaxIdle,
+		MaxActive:   c.MaxActive,
+		IdleTimeout: c.IdleTimeout,
+		Wait:        true,
+		Dial: func() (redis.Conn, error) {
+			address := c.Address
+			if len(c.SentinelAddresses) > 0 {
+				var err error
+				if address, err = masterAddress(c); err != nil {
+					return nil, err
+				}
+			}
+			utils.Debug("Connect redis server, address is", address)
+			return redis.Dial("tcp", address, dialOptions(c)...)
+		},
+		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
+			// a master demoted by failover still accepts connections,
+			// so the role is checked on every borrow when sentinels are used
+			if len(c.SentinelAddresses) > 0 {
+				role, err := redis.Values(conn.Do("ROLE"))
+				if err != nil {
+					return err
+				}
+				if len(role) == 0 || string(role[0].([]byte)) != "master" {
+					return errors.New("redis server is not master any more")
+				}
+				return nil
+			}
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+}
+
+func dialOptions(c Config) []redis.DialOption {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(c.ConnectTimeout),
+		redis.DialReadTimeout(c.ReadTimeout),
+		redis.DialWriteTimeout(c.WriteTimeout),
+		redis.DialDatabase(c.Database),
+	}
+	if c.Password != "" {
+		options = append(options, redis.DialPassword(c.Password))
+	}
+	if c.TLS {
+		options = append(options,
+			redis.DialUseTLS(true),
+			redis.DialTLSConfig(&tls.Config{InsecureSkipVerify: c.TLSSkipVerify}),
+			redis.DialTLSSkipVerify(c.TLSSkipVerify),
+		)
+	}
+	return options
+}
+
+// masterAddress asks the sentinels in turn for the address of current master
+func masterAddress(c Config) (string, error) {
+	for _, sentinel := range c.SentinelAddresses {
+		conn, err := redis.Dial("tcp", sentinel,
+			redis.DialConnectTimeout(c.ConnectTimeout),
+			redis.DialReadTimeout(c.ReadTimeout),
+			redis.DialWriteTimeout(c.WriteTimeout),
+		)
+		if err != nil {
+			log.Println("Connect redis sentinel", sentinel, "failed:", err)
+			continue
+		}
+		master, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", c.SentinelMaster))
+		conn.Close()
+		if err != nil || len(master) != 2 {
+			log.Println("Get master", c.SentinelMaster, "from sentinel", sentinel, "failed:", err)
+			continue
+		}
+		return net.JoinHostPort(master[0], master[1]), nil
+	}
+	log.Println("No sentinel knows master", c.SentinelMaster)
+	return "", ErrNoMaster
+}
+
+// IsUnavailable tells whether err is returned because no redis server can be reached
+func IsUnavailable(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == ErrNoMaster || err == redis.ErrPoolExhausted || err == io.EOF || err == io.ErrUnexpectedEOF
+}
@@ -1,27 +1,42 @@
 package redis
 
 import (
-	"github.com/garyburd/redigo/redis"
+	"backup/utils"
 	"encoding/json"
+	"errors"
+	"github.com/garyburd/redigo/redis"
 	"log"
+	"strings"
+	"time"
 )
 
+// ErrNotFound is returned when an element or its progress does not exist
+var ErrNotFound = errors.New("not found")
+
+// batchSize is the number of keys fetched by one MGET or SCAN
+const batchSize = 500
+
+// pingInterval is how often an idle subscription is pinged, the read timeout of the
+// pool does not apply to subscriptions which are considered broken once no reply
+// comes for three intervals
+const pingInterval = 10 * time.Second
+
 type RedisHandler struct {
-	address string
+	pool      *redis.Pool
 	namespace string
 }
 
-func New(address string, namespace string) *RedisHandler{
-	return &RedisHandler{address, namespace}
+func New(pool *redis.Pool, namespace string) *RedisHandler {
+	return &RedisHandler{pool, namespace}
 }
 
-func (h *RedisHandler) connect() (redis.Conn, error){
-	log.Println("Connect redis server, address is", h.address)
-	client, err := redis.Dial("tcp", h.address)
-	if err != nil {
+// connect takes a connection from pool, Close gives it back
+func (h *RedisHandler) connect() (redis.Conn, error) {
+	client := h.pool.Get()
+	if err := client.Err(); err != nil {
+		client.Close()
 		return nil, err
 	}
-	log.Println("Redis server is connected")
 	return client, nil
 }
 
@@ -36,13 +51,29 @@ func (h *RedisHandler) Add(i interface{}, uuid string) error {
 	}
 	defer client.Close()
 
-	_, err = client.Do("SET", h.namespace + "-" + uuid, string(b))
+	// the element, its list entry and indexes are written together, LREM keeps the list free of duplicates
+	return h.transaction(client, uuid, newIndexRecord(i), func() {
+		client.Send("SET", h.namespace+"-"+uuid, string(b))
+		client.Send("LREM", h.namespace+"-list", 0, uuid)
+		client.Send("RPUSH", h.namespace+"-list", uuid)
+	})
+}
+
+// Update overwrites an element which is already in the list
+func (h *RedisHandler) Update(i interface{}, uuid string) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	client, err := h.connect()
 	if err != nil {
 		return err
 	}
+	defer client.Close()
 
-	client.Do("RPUSH", h.namespace + "-list", uuid)
-	return nil
+	return h.transaction(client, uuid, newIndexRecord(i), func() {
+		client.Send("SET", h.namespace+"-"+uuid, string(b))
+	})
 }
 
 func (h *RedisHandler) Load(uuid string) ([]byte, error) {
@@ -52,7 +83,11 @@ func (h *RedisHandler) Load(uuid string) ([]byte, error) {
 	}
 	defer client.Close()
 
-	return redis.Bytes(client.Do("GET", h.namespace + "-" + uuid))
+	b, err := redis.Bytes(client.Do("GET", h.namespace+"-"+uuid))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	return b, err
 }
 
 func (h *RedisHandler) List() ([]string, error) {
@@ -62,23 +97,18 @@ func (h *RedisHandler) List() ([]string, error) {
 	}
 	defer client.Close()
 
-	log.Println("Loading list from namespace",  h.namespace)
-	vs, err := redis.Values(client.Do("LRANGE", h.namespace + "-list", 0, -1)) // take all element
+	utils.Debug("Loading list from namespace", h.namespace)
+	vs, err := redis.Values(client.Do("LRANGE", h.namespace+"-list", 0, -1)) // take all element
 	if err != nil {
 		return nil, err
 	}
-	log.Println("Loading list from", h.namespace, "done")
+	utils.Debug("Loading list from", h.namespace, "done")
 
-	list := make([]string, 0)
-	for _, v  := range vs {
-		uuid := string(v.([]byte))
-		v, err := redis.String(client.Do("GET", h.namespace + "-" + uuid))
-		if err != nil {
-			continue
-		}
-		list = append(list, v)
+	uuids, err := redis.Strings(vs, nil)
+	if err != nil {
+		return nil, err
 	}
-	return list, nil
+	return h.mget(client, uuids)
 }
 
 func (h *RedisHandler) Delete(uuid string) error {
@@ -88,15 +118,89 @@ func (h *RedisHandler) Delete(uuid string) error {
 	}
 	defer client.Close()
 
-	log.Println("Removing element", uuid, "from namespace",  h.namespace)
+	log.Println("Removing element", uuid, "from namespace", h.namespace)
 
 	element := h.namespace + "-" + uuid
-	_, err = client.Do("DEL", element, element + "-progress")
+	return h.transaction(client, uuid, nil, func() {
+		client.Send("DEL", element, element+"-progress")
+		client.Send("LREM", h.namespace+"-list", 0, uuid)
+	})
+}
+
+// Repair reconciles the list and indexes of namespace with the stored elements: entries
+// without an element and duplicated entries are dropped, elements missing from the list
+// are appended, progress of removed elements is deleted and indexes are rebuilt
+func (h *RedisHandler) Repair() error {
+	client, err := h.connect()
 	if err != nil {
 		return err
 	}
-	_, err = client.Do("LREM", h.namespace + "-list", 0, uuid)
-	return err
+	defer client.Close()
+
+	listKey := h.namespace + "-list"
+	prefix := h.namespace + "-"
+
+	elements := make(map[string]bool)
+	progresses := make([]string, 0)
+	keys, err := scan(client, prefix+"*")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		switch {
+		case key == listKey:
+		case strings.HasSuffix(key, "-progress"):
+			progresses = append(progresses, key)
+		default:
+			elements[strings.TrimPrefix(key, prefix)] = true
+		}
+	}
+
+	uuids, err := redis.Strings(client.Do("LRANGE", listKey, 0, -1))
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, uuid := range uuids {
+		if !elements[uuid] {
+			log.Println("Removing dangling entry", uuid, "from namespace", h.namespace)
+			if _, err := client.Do("LREM", listKey, 0, uuid); err != nil {
+				return err
+			}
+			continue
+		}
+		if listed[uuid] {
+			log.Println("Removing duplicated entry", uuid, "from namespace", h.namespace)
+			// keep the first occurrence, LREM with negative count removes from the tail
+			if _, err := client.Do("LREM", listKey, -1, uuid); err != nil {
+				return err
+			}
+			continue
+		}
+		listed[uuid] = true
+	}
+
+	for uuid := range elements {
+		if listed[uuid] {
+			continue
+		}
+		log.Println("Adding orphan element", uuid, "to namespace", h.namespace)
+		if _, err := client.Do("RPUSH", listKey, uuid); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range progresses {
+		uuid := strings.TrimSuffix(strings.TrimPrefix(key, prefix), "-progress")
+		if elements[uuid] {
+			continue
+		}
+		log.Println("Removing orphan progress", uuid, "from namespace", h.namespace)
+		if _, err := client.Do("DEL", key); err != nil {
+			return err
+		}
+	}
+	return h.repairIndexes(client, elements)
 }
 
 func (h *RedisHandler) IsExists(uuid string) (bool, error) {
@@ -107,7 +211,7 @@ func (h *RedisHandler) IsExists(uuid string) (bool, error) {
 	defer client.Close()
 
 	key := h.namespace + "-" + uuid
-    ok, err := redis.Bool(client.Do("EXISTS", key))
+	ok, err := redis.Bool(client.Do("EXISTS", key))
 	if err != nil {
 		return false, err
 	}
@@ -121,16 +225,97 @@ func (h *RedisHandler) GetProgress(uuid string) (string, error) {
 	}
 	defer client.Close()
 
-	return redis.String(client.Do("GET", h.namespace + "-" + uuid + "-progress"))
+	progress, err := redis.String(client.Do("GET", h.namespace+"-"+uuid+"-progress"))
+	if err == redis.ErrNil {
+		return "", ErrNotFound
+	}
+	return progress, err
 }
 
-func (h *RedisHandler) UpdateProgress(uuid string, percentage int) error {
+func (h *RedisHandler) UpdateProgress(uuid string, i interface{}) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
 	client, err := h.connect()
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	_, err = client.Do("SET", h.namespace + "-" + uuid + "-progress", percentage)
+	_, err = client.Do("SET", h.namespace+"-"+uuid+"-progress", string(b))
 	return err
 }
+
+// Publish sends a message to the subscribers of the namespace
+func (h *RedisHandler) Publish(i interface{}) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	client, err := h.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	_, err = client.Do("PUBLISH", h.namespace+"-events", string(b))
+	return err
+}
+
+// Subscribe delivers the messages published in the namespace until stop is closed
+// or the connection is broken, the returned channel is closed then
+func (h *RedisHandler) Subscribe(stop <-chan struct{}) (<-chan []byte, error) {
+	// subscriptions are long lived, they get their own connection instead of one from pool
+	client, err := h.pool.Dial()
+	if err != nil {
+		return nil, err
+	}
+	psc := redis.PubSubConn{Conn: client}
+	if err := psc.Subscribe(h.namespace + "-events"); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	messages := make(chan []byte)
+	done := make(chan struct{})
+	go func() {
+		// closing the connection unblocks Receive
+		select {
+		case <-stop:
+		case <-done:
+		}
+		client.Close()
+	}()
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer close(messages)
+		defer close(done)
+		for {
+			switch v := psc.ReceiveWithTimeout(3 * pingInterval).(type) {
+			case redis.Message:
+				select {
+				case messages <- v.Data:
+				case <-stop:
+					return
+				}
+			case error:
+				return
+			}
+		}
+	}()
+	return messages, nil
+}
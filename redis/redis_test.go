@@ -0,0 +1,44 @@
+package redis
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestSubscribeIdle checks that a subscription outlives the read timeout of the pool,
+// it runs when BACKUP_TEST_REDIS is set to the address of a server
+func TestSubscribeIdle(t *testing.T) {
+	address := os.Getenv("BACKUP_TEST_REDIS")
+	if address == "" {
+		t.Skip("BACKUP_TEST_REDIS is not set")
+	}
+	readTimeout := 500 * time.Millisecond
+	pool := NewPool(Config{Address: address, MaxIdle: 2, IdleTimeout: time.Minute, ReadTimeout: readTimeout})
+	defer pool.Close()
+	h := New(pool, "test-idle")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	messages, err := h.Subscribe(stop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m, ok := <-messages:
+		t.Fatalf("idle subscription received %q, open %v", m, ok)
+	case <-time.After(4 * readTimeout):
+	}
+
+	if err := h.Publish("a"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m, ok := <-messages:
+		if !ok || string(m) != `"a"` {
+			t.Errorf("received %q, open %v", m, ok)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+}
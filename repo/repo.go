@@ -1,58 +1,138 @@
 package repo
 
 import (
+	"backup/compress"
+	"backup/storage"
+	"backup/store"
+	"backup/utils"
 	"encoding/json"
 	"errors"
-	"backup/redis"
-	"backup/utils"
-	"os"
-	"syscall"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	TypeDir   = "dir"   // backups are files in a local directory
+	TypeDedup = "dedup" // backups are split into chunks stored once in a local directory
+	TypeS3    = "s3"    // backups are objects of an S3 compatible bucket
+	TypeSFTP  = "sftp"  // backups are files in a directory of a remote host reached over SSH
 )
 
 type Repository struct {
-	Uuid  string `json:"uuid"`
-	Name  string `json:"name"`
-	Path  string `json:"path"`
-	Free  uint64 `json:"free_space,omitempty"`
-	Total uint64 `json:"total_space,omitempty"`
+	Uuid        string              `json:"uuid"`
+	Name        string              `json:"name"`
+	Type        string              `json:"type,omitempty"` // dir if empty
+	Path        string              `json:"path,omitempty"` // the directory of dir and dedup repositories
+	S3          *storage.S3Config   `json:"s3,omitempty"`
+	SFTP        *storage.SFTPConfig `json:"sftp,omitempty"`
+	Free        uint64              `json:"free_space,omitempty"`
+	Total       uint64              `json:"total_space,omitempty"`
+	CreatedTime uint64              `json:"created_time,omitempty"`
+	Compression string              `json:"compression,omitempty"` // codec of the backups, none if empty
+	Encrypted   bool                `json:"encrypted,omitempty"`
+}
+
+// Indexes lets repositories be filtered by name
+func (repo Repository) Indexes() map[string]string {
+	return map[string]string{"name": repo.Name}
+}
+
+// Score sorts repositories by creation time, the ones created before it was
+// recorded come first
+func (repo Repository) Score() uint64 {
+	return repo.CreatedTime
+}
+
+// TypeName returns the type of the repository, repositories created before
+// there were types are directories
+func (repo *Repository) TypeName() string {
+	if repo.Type == "" {
+		return TypeDir
+	}
+	return repo.Type
+}
+
+// Storage returns the storage keeping the files of the repository
+func (repo *Repository) Storage() (storage.Storage, error) {
+	switch repo.TypeName() {
+	case TypeDir:
+		return storage.NewDir(repo.Path), nil
+	case TypeDedup:
+		return storage.NewDedup(repo.Path), nil
+	case TypeS3:
+		if repo.S3 == nil {
+			return nil, errors.New("s3 repository " + repo.Uuid + " has no s3 settings")
+		}
+		return storage.NewS3(*repo.S3)
+	case TypeSFTP:
+		if repo.SFTP == nil {
+			return nil, errors.New("sftp repository " + repo.Uuid + " has no sftp settings")
+		}
+		return storage.NewSFTP(*repo.SFTP)
+	}
+	return nil, errors.New("unknown repository type " + repo.Type)
+}
+
+// Masked returns a copy of the repository without its secrets to be shown
+func (repo Repository) Masked() Repository {
+	if repo.S3 != nil && repo.S3.SecretKey != "" {
+		s3 := *repo.S3
+		s3.SecretKey = "******"
+		repo.S3 = &s3
+	}
+	return repo
+}
+
+// FullName is the file of the full backup of an image in the repository, snap is empty
+// for the backup of image head. Files are kept under the cluster and pool of the image
+// so that images of the same name in different pools do not collide.
+func (repo *Repository) FullName(cluster string, pool string, image string, snap string) string {
+	name := cluster + "/" + pool + "/" + image
+	if snap == "" {
+		return name
+	}
+	return name + "@" + snap
+}
+
+// DiffName is the file of the difference of an image between two snapshots
+func (repo *Repository) DiffName(cluster string, pool string, image string, start string, end string) string {
+	return cluster + "/" + pool + "/" + image + "@" + start + "_to_" + end + ".diff"
 }
 
 type RepositoryHandler struct {
-	redis *redis.RedisHandler
+	store store.Store
 }
 
-func NewRepositoryHandler(redisAddress string) *RepositoryHandler {
-	rh := redis.New(redisAddress, "repo")
+func NewRepositoryHandler(backend store.Backend) *RepositoryHandler {
+	rh := backend.Namespace("repo")
 	return &RepositoryHandler{rh}
 }
 
 func (rh *RepositoryHandler) AddRepo(repo *Repository) (string, error) {
-	f, err := os.Stat(repo.Path)
-	if err != nil {
+	if err := repo.validate(); err != nil {
 		return "", err
 	}
-	if !f.IsDir() {
-		return "", errors.New("path " + repo.Path + " is not directory")
-	}
 
 	uuid, err := utils.MakeUuid()
 	if err != nil {
 		return "", err
 	}
 	repo.Uuid = uuid
-	err = rh.redis.Add(repo, uuid)
+	repo.CreatedTime = uint64(time.Now().Unix())
+	err = rh.store.Add(repo, uuid)
 	return uuid, err
 }
 
+// LoadRepo returns the repository without its space, which is only asked for by listings
 func (rh *RepositoryHandler) LoadRepo(uuid string) (Repository, error) {
-	bs, err := rh.redis.Load(uuid)
-
-	repo := Repository{}
-	err = json.Unmarshal(bs, &repo)
+	bs, err := rh.store.Load(uuid)
 	if err != nil {
 		return Repository{}, err
 	}
-	repo.Free, repo.Total, err = rh.getSpaceInfo(repo.Path)
+
+	repo := Repository{}
+	err = json.Unmarshal(bs, &repo)
 	if err != nil {
 		return Repository{}, err
 	}
@@ -60,7 +140,7 @@ func (rh *RepositoryHandler) LoadRepo(uuid string) (Repository, error) {
 }
 
 func (rh *RepositoryHandler) ListRepo() ([]Repository, error) {
-	list, err := rh.redis.List()
+	list, err := rh.store.List()
 	if err != nil {
 		return []Repository{}, err
 	}
@@ -72,30 +152,152 @@ func (rh *RepositoryHandler) ListRepo() ([]Repository, error) {
 		if err != nil {
 			continue
 		}
-		repo.Free, repo.Total, err = rh.getSpaceInfo(repo.Path)
+		repo.Free, repo.Total, err = rh.getSpaceInfo(&repo)
 		if err != nil {
-			continue
+			log.Println("Get space of repository", repo.Uuid, "failed:", err)
 		}
 		repos = append(repos, repo)
 	}
 	return repos, nil
 }
 
+// QueryRepo returns the page of repositories selected by q and the number of all matching ones
+func (rh *RepositoryHandler) QueryRepo(q store.Query) ([]Repository, int, error) {
+	list, total, err := rh.store.Query(q)
+	if err != nil {
+		return []Repository{}, 0, err
+	}
+
+	repos := make([]Repository, 0, len(list))
+	for _, s := range list {
+		repo := Repository{}
+		err := json.Unmarshal([]byte(s), &repo)
+		if err != nil {
+			continue
+		}
+		repo.Free, repo.Total, err = rh.getSpaceInfo(&repo)
+		if err != nil {
+			log.Println("Get space of repository", repo.Uuid, "failed:", err)
+		}
+		repos = append(repos, repo)
+	}
+	return repos, total, nil
+}
+
+// Reindex indexes the repositories stored before repositories could be queried
+// or before some of their indexes were added
+func (rh *RepositoryHandler) Reindex() error {
+	names := make([]string, 0)
+	for name := range (Repository{}).Indexes() {
+		names = append(names, name)
+	}
+	uuids, err := rh.store.Unindexed(names...)
+	if err != nil {
+		return err
+	}
+	for _, uuid := range uuids {
+		bs, err := rh.store.Load(uuid)
+		if err != nil {
+			continue
+		}
+		repo := Repository{}
+		if err := json.Unmarshal(bs, &repo); err != nil {
+			continue
+		}
+		if err := rh.store.Update(repo, uuid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (rh *RepositoryHandler) RemoveRepo(uuid string) error {
-	return rh.redis.Delete(uuid)
+	spaceMutex.Lock()
+	delete(spaces, uuid)
+	spaceMutex.Unlock()
+	return rh.store.Delete(uuid)
 }
 
 func (rh *RepositoryHandler) IsExists(uuid string) (bool, error) {
-	return rh.redis.IsExists(uuid)
+	return rh.store.IsExists(uuid)
 }
 
-func (rh *RepositoryHandler) getSpaceInfo(path string) (uint64, uint64, error) {
+// validate checks the options of the repository and that its storage can be used
+func (repo *Repository) validate() error {
+	if err := compress.Validate(repo.Compression); err != nil {
+		return err
+	}
+	switch repo.TypeName() {
+	case TypeDir:
+		return storage.NewDir(repo.Path).Check()
+	case TypeDedup:
+		// chunks of compressed or encrypted streams would hardly ever match
+		if (repo.Compression != "" && repo.Compression != compress.None) || repo.Encrypted {
+			return errors.New("dedup repositories can not be compressed or encrypted")
+		}
+		return storage.NewDedup(repo.Path).Check()
+	case TypeS3:
+		if repo.S3 == nil {
+			return errors.New("s3 settings are required")
+		}
+		st, err := storage.NewS3(*repo.S3)
+		if err != nil {
+			return err
+		}
+		return st.Check()
+	case TypeSFTP:
+		if repo.SFTP == nil {
+			return errors.New("sftp settings are required")
+		}
+		st, err := storage.NewSFTP(*repo.SFTP)
+		if err != nil {
+			return err
+		}
+		return st.Check()
+	}
+	return errors.New("unknown repository type " + repo.Type + ", expect dir, dedup, s3 or sftp")
+}
+
+// spaceTTL is how long the space of a remote repository is kept before it is asked again
+const spaceTTL = time.Minute
 
-	fs := syscall.Statfs_t{}
-	if err := syscall.Statfs(path, &fs); err != nil {
+type space struct {
+	free    uint64
+	total   uint64
+	checked time.Time
+}
+
+// space of remote repositories by uuid
+var (
+	spaceMutex sync.Mutex
+	spaces     = make(map[string]space)
+)
+
+// getSpaceInfo returns the free and total bytes of the repository. Remote repositories
+// are asked at most once per spaceTTL, the space of the ones which can not be reached
+// is left unknown.
+func (rh *RepositoryHandler) getSpaceInfo(repo *Repository) (uint64, uint64, error) {
+	st, err := repo.Storage()
+	if err != nil {
 		return 0, 0, err
 	}
-	free := fs.Bfree * uint64(fs.Bsize)
-	total := fs.Blocks * uint64(fs.Bsize)
+	if _, local := st.(storage.Local); local {
+		return st.Space()
+	}
+
+	spaceMutex.Lock()
+	s, ok := spaces[repo.Uuid]
+	spaceMutex.Unlock()
+	if ok && time.Since(s.checked) < spaceTTL {
+		return s.free, s.total, nil
+	}
+	free, total, err := st.Space()
+	if err != nil {
+		log.Println("Get space of repository", repo.Uuid, "failed:", err)
+		free, total = 0, 0
+	}
+	spaceMutex.Lock()
+	spaces[repo.Uuid] = space{free, total, time.Now()}
+	spaceMutex.Unlock()
 	return free, total, nil
 }
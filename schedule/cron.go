@@ -0,0 +1,183 @@
+package schedule
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed standard 5 field cron expression:
+// minute hour day-of-month month day-of-week
+type Cron struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// day of month and day of week are OR'ed when both are restricted
+	domStar bool
+	dowStar bool
+}
+
+type bounds struct {
+	min   uint
+	max   uint
+	names map[string]uint
+}
+
+var (
+	minutes = bounds{0, 59, nil}
+	hours   = bounds{0, 23, nil}
+	doms    = bounds{1, 31, nil}
+	months  = bounds{1, 12, map[string]uint{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dows = bounds{0, 7, map[string]uint{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func ParseCron(expr string) (*Cron, error) {
+	expr = strings.TrimSpace(expr)
+	if d, ok := descriptors[strings.ToLower(expr)]; ok {
+		expr = d
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression " + expr + " must have 5 fields")
+	}
+
+	c := Cron{}
+	var err error
+	if c.minute, err = parseField(fields[0], minutes); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseField(fields[1], hours); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseField(fields[2], doms); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseField(fields[3], months); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseField(fields[4], dows); err != nil {
+		return nil, err
+	}
+	// 7 is also sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	// like Vixie cron, a field starting with * such as */2 is unrestricted
+	c.domStar = strings.HasPrefix(fields[2], "*") || fields[2] == "?"
+	c.dowStar = strings.HasPrefix(fields[4], "*") || fields[4] == "?"
+	return &c, nil
+}
+
+// parseField parses a comma separated list of "*", "a", "a-b" items with an optional "/step"
+func parseField(field string, b bounds) (uint64, error) {
+	bits := uint64(0)
+	for _, item := range strings.Split(field, ",") {
+		step := uint(1)
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.ParseUint(item[i+1:], 10, 8)
+			if err != nil || n == 0 {
+				return 0, errors.New("invalid step in cron field " + field)
+			}
+			step = uint(n)
+			item = item[:i]
+		}
+
+		var start, end uint
+		switch {
+		case item == "*" || item == "?":
+			start, end = b.min, b.max
+		case strings.Contains(item, "-"):
+			parts := strings.SplitN(item, "-", 2)
+			var err error
+			if start, err = parseValue(parts[0], b); err != nil {
+				return 0, err
+			}
+			if end, err = parseValue(parts[1], b); err != nil {
+				return 0, err
+			}
+		default:
+			var err error
+			if start, err = parseValue(item, b); err != nil {
+				return 0, err
+			}
+			end = start
+			if step > 1 {
+				end = b.max
+			}
+		}
+		if start > end {
+			return 0, errors.New("invalid range in cron field " + field)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(s string, b bounds) (uint, error) {
+	if v, ok := b.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil || uint(n) < b.min || uint(n) > b.max {
+		return 0, errors.New("value " + s + " is out of range in cron expression")
+	}
+	return uint(n), nil
+}
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t which matches the expression,
+// zero time is returned if nothing matches within 5 years
+func (c *Cron) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
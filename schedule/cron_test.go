@@ -0,0 +1,82 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr string
+		from string
+		want string // empty if nothing matches
+	}{
+		{"*/15 * * * *", "2024-01-01 00:07", "2024-01-01 00:15"},
+		{"30 2 * * *", "2024-01-01 02:30", "2024-01-02 02:30"},
+		{"@hourly", "2024-01-01 23:59", "2024-01-02 00:00"},
+		{"@monthly", "2024-01-31 12:00", "2024-02-01 00:00"},
+		{"@weekly", "2024-01-01 00:00", "2024-01-07 00:00"},
+		// both days restricted: either one matches
+		{"0 0 1 * 1", "2024-01-02 00:00", "2024-01-08 00:00"},
+		{"0 0 1 * 1", "2024-01-29 00:00", "2024-02-01 00:00"},
+		{"0 0 13 * fri", "2024-01-01 00:00", "2024-01-05 00:00"},
+		// a day field starting with * is unrestricted: both must match
+		{"0 0 */2 * 1", "2024-01-01 00:00", "2024-01-15 00:00"},
+		{"0 0 1 * */2", "2024-01-01 00:00", "2024-02-01 00:00"},
+		{"0 0 ? * 1", "2024-01-02 00:00", "2024-01-08 00:00"},
+		{"0 0 1 * *", "2024-01-02 00:00", "2024-02-01 00:00"},
+		{"0 0 * * 7", "2024-01-01 00:00", "2024-01-07 00:00"},
+		{"0 0 * * mon-fri", "2024-01-06 00:00", "2024-01-08 00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 31 * *", "2024-04-01 00:00", "2024-05-31 00:00"},
+		{"0 0 31 2 *", "2024-01-01 00:00", ""},
+		{"0 0 1,15 jan,jul *", "2024-01-15 00:00", "2024-07-01 00:00"},
+	}
+	for _, test := range tests {
+		c, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		next := c.Next(date(test.from))
+		if test.want == "" {
+			if !next.IsZero() {
+				t.Errorf("%s from %s: %s, want none", test.expr, test.from, next)
+			}
+			continue
+		}
+		if want := date(test.want); !next.Equal(want) {
+			t.Errorf("%s from %s: %s, want %s", test.expr, test.from, next, want)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"0 0 0 * *",
+		"0 0 32 * *",
+		"0 0 * 13 *",
+		"0 0 * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"0 0 * foo *",
+		"@often",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%q is accepted", expr)
+		}
+	}
+}
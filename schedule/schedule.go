@@ -0,0 +1,197 @@
+package schedule
+
+import (
+	"backup/job"
+	"backup/store"
+	"backup/utils"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+type Schedule struct {
+	Uuid        string   `json:"uuid"`
+	Name        string   `json:"name"`
+	Cron        string   `json:"cron"`
+	Timezone    string   `json:"timezone,omitempty"`
+	Enabled     bool     `json:"enabled"`
+	Task        job.Task `json:"task"`
+	CreatedTime uint64   `json:"created_time"`
+	LastTime    uint64   `json:"last_time,omitempty"`
+	LastJob     string   `json:"last_job,omitempty"`
+	NextTime    uint64   `json:"next_time,omitempty"`
+}
+
+// Validate checks the cron expression, timezone and task template
+func (s *Schedule) Validate() error {
+	if _, err := ParseCron(s.Cron); err != nil {
+		return err
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return err
+	}
+	return s.Task.Validate()
+}
+
+// Next returns the first time after t the schedule is due in its timezone
+func (s *Schedule) Next(t time.Time) (time.Time, error) {
+	cron, err := ParseCron(s.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cron.Next(t.In(loc)), nil
+}
+
+type ScheduleHandler struct {
+	rh store.Store
+}
+
+func NewScheduleHandler(backend store.Backend) *ScheduleHandler {
+	rh := backend.Namespace("schedule")
+	return &ScheduleHandler{rh}
+}
+
+func (sh *ScheduleHandler) AddSchedule(s *Schedule) (string, error) {
+	uuid, err := utils.MakeUuid()
+	if err != nil {
+		return "", err
+	}
+	s.Uuid = uuid
+	s.CreatedTime = uint64(time.Now().Unix())
+	s.LastTime = 0
+	s.LastJob = ""
+	s.NextTime = 0
+	err = sh.rh.Add(s, uuid)
+	return uuid, err
+}
+
+func (sh *ScheduleHandler) LoadSchedule(uuid string) (*Schedule, error) {
+	bs, err := sh.rh.Load(uuid)
+	if err != nil {
+		return &Schedule{}, err
+	}
+	s := Schedule{}
+	err = json.Unmarshal(bs, &s)
+	if err != nil {
+		return &Schedule{}, err
+	}
+	return &s, nil
+}
+
+func (sh *ScheduleHandler) UpdateSchedule(s *Schedule) error {
+	s.NextTime = 0
+	return sh.rh.Update(s, s.Uuid)
+}
+
+func (sh *ScheduleHandler) ListSchedule() ([]Schedule, error) {
+	list, err := sh.rh.List()
+	if err != nil {
+		return []Schedule{}, err
+	}
+
+	schedules := make([]Schedule, 0)
+	for _, str := range list {
+		s := Schedule{}
+		err := json.Unmarshal([]byte(str), &s)
+		if err != nil {
+			continue
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+func (sh *ScheduleHandler) RemoveSchedule(uuid string) error {
+	return sh.rh.Delete(uuid)
+}
+
+func (sh *ScheduleHandler) IsExists(uuid string) (bool, error) {
+	return sh.rh.IsExists(uuid)
+}
+
+// Scheduler creates and submits a job for every enabled schedule which is due
+type Scheduler struct {
+	sh     *ScheduleHandler
+	jh     *job.JobHandler
+	runner *job.Runner
+}
+
+func NewScheduler(sh *ScheduleHandler, jh *job.JobHandler, runner *job.Runner) *Scheduler {
+	return &Scheduler{sh, jh, runner}
+}
+
+// Run checks the schedules every interval, it never returns
+func (s *Scheduler) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.tick(now)
+	}
+}
+
+func (s *Scheduler) tick(now time.Time) {
+	schedules, err := s.sh.ListSchedule()
+	if err != nil {
+		log.Println("List schedules failed:", err)
+		return
+	}
+
+	for _, schedule := range schedules {
+		if !schedule.Enabled {
+			continue
+		}
+		last := schedule.LastTime
+		if last == 0 {
+			last = schedule.CreatedTime
+		}
+		next, err := schedule.Next(time.Unix(int64(last), 0))
+		if err != nil {
+			log.Println("Schedule", schedule.Uuid, "is invalid:", err)
+			continue
+		}
+		if next.IsZero() || next.After(now) {
+			continue
+		}
+		s.trigger(schedule.Uuid, now)
+	}
+}
+
+// trigger materializes a job from the schedule, runs missed while the
+// service was down are collapsed into one
+func (s *Scheduler) trigger(uuid string, now time.Time) {
+	// reload to not overwrite changes made since the list was taken
+	schedule, err := s.sh.LoadSchedule(uuid)
+	if err != nil {
+		log.Println("Load schedule", uuid, "failed:", err)
+		return
+	}
+	if !schedule.Enabled {
+		return
+	}
+
+	j, err := s.jh.CreateJob(schedule.Task)
+	if err != nil {
+		log.Println("Create job of schedule", uuid, "failed:", err)
+		return
+	}
+	log.Println("Schedule", uuid, "created job", j.Uuid)
+
+	// the run is saved before the job is submitted, a run which could not be
+	// saved would be fired again on the next tick
+	schedule.LastTime = uint64(now.Unix())
+	schedule.LastJob = j.Uuid
+	if err := s.sh.UpdateSchedule(schedule); err != nil {
+		log.Println("Update schedule", uuid, "failed:", err)
+		j.Error = "update schedule failed: " + err.Error()
+		j.ExitCode = -1
+		if err := j.Transit(job.StateFailed); err == nil {
+			s.jh.UpdateJob(j)
+		}
+		return
+	}
+	s.runner.Submit(j)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"backup/repo"
+	"backup/schedule"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+// fillNextTime sets the next time a schedule is due, it is not persisted
+func fillNextTime(s *schedule.Schedule) {
+	if !s.Enabled {
+		return
+	}
+	next, err := s.Next(time.Now())
+	if err == nil && !next.IsZero() {
+		s.NextTime = uint64(next.Unix())
+	}
+}
+
+// validateSchedule checks the schedule and the repository its task refers to,
+// the error response is sent if it is invalid
+func validateSchedule(w http.ResponseWriter, r *http.Request, s *schedule.Schedule) bool {
+	if err := s.Validate(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid schedule", err)
+		return false
+	}
+	if !checkClusters(w, r, s.Task) {
+		return false
+	}
+	rh := repo.NewRepositoryHandler(backend)
+	ok, err := rh.IsExists(s.Task.RepoUuid)
+	if err != nil {
+		writeFailure(w, r, "load repository "+s.Task.RepoUuid+" failed", err)
+		return false
+	}
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "repository "+s.Task.RepoUuid+" is not found", nil)
+		return false
+	}
+	return true
+}
+
+func GetSchedules(w http.ResponseWriter, r *http.Request) {
+	sh := schedule.NewScheduleHandler(backend)
+	schedules, err := sh.ListSchedule()
+	if err != nil {
+		writeFailure(w, r, "list schedules failed", err)
+		return
+	}
+	for i := range schedules {
+		fillNextTime(&schedules[i])
+	}
+	json.NewEncoder(w).Encode(schedules)
+}
+
+func GetSchedule(w http.ResponseWriter, r *http.Request) {
+	sh := schedule.NewScheduleHandler(backend)
+	uuid := mux.Vars(r)["uuid"]
+	s, err := sh.LoadSchedule(uuid)
+	if err != nil {
+		writeFailure(w, r, "load schedule "+uuid+" failed", err)
+		return
+	}
+	fillNextTime(s)
+	json.NewEncoder(w).Encode(s)
+}
+
+func CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	s := schedule.Schedule{}
+	err := json.NewDecoder(r.Body).Decode(&s)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid schedule", err)
+		return
+	}
+	if !validateSchedule(w, r, &s) {
+		return
+	}
+
+	sh := schedule.NewScheduleHandler(backend)
+	_, err = sh.AddSchedule(&s)
+	if err != nil {
+		writeFailure(w, r, "add schedule failed", err)
+		return
+	}
+	fillNextTime(&s)
+	json.NewEncoder(w).Encode(s)
+}
+
+func UpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	sh := schedule.NewScheduleHandler(backend)
+	uuid := mux.Vars(r)["uuid"]
+	old, err := sh.LoadSchedule(uuid)
+	if err != nil {
+		writeFailure(w, r, "load schedule "+uuid+" failed", err)
+		return
+	}
+
+	s := schedule.Schedule{}
+	err = json.NewDecoder(r.Body).Decode(&s)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid schedule", err)
+		return
+	}
+	if !validateSchedule(w, r, &s) {
+		return
+	}
+	// bookkeeping fields are owned by the scheduler
+	s.Uuid = old.Uuid
+	s.CreatedTime = old.CreatedTime
+	s.LastTime = old.LastTime
+	s.LastJob = old.LastJob
+
+	err = sh.UpdateSchedule(&s)
+	if err != nil {
+		writeFailure(w, r, "update schedule "+uuid+" failed", err)
+		return
+	}
+	fillNextTime(&s)
+	json.NewEncoder(w).Encode(s)
+}
+
+func DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	sh := schedule.NewScheduleHandler(backend)
+	uuid := mux.Vars(r)["uuid"]
+	ok, err := sh.IsExists(uuid)
+	if err != nil {
+		writeFailure(w, r, "delete schedule "+uuid+" failed", err)
+		return
+	}
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "schedule "+uuid+" is not found", nil)
+		return
+	}
+	err = sh.RemoveSchedule(uuid)
+	if err != nil {
+		writeFailure(w, r, "delete schedule "+uuid+" failed", err)
+		return
+	}
+}
@@ -0,0 +1,95 @@
+package storage
+
+// Streams are split into chunks by content so that data which is unchanged
+// between backups, even if shifted, gives the same chunks. A boundary is where
+// the gear hash of the bytes since the minimum size has its low bits clear.
+const (
+	minChunk = 512 << 10
+	maxChunk = 8 << 20
+	// boundaries are found every 2 MiB on average
+	chunkMask = 1<<21 - 1
+)
+
+// gear maps bytes to random numbers, it must never change or the chunks of
+// new backups would not match the stored ones
+var gear [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed
+	x := uint64(0x6a09e667f3bcc908)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		gear[i] = z ^ z>>31
+	}
+}
+
+// chunker passes the chunks of what is written to emit, the hash of the bytes
+// looked at is kept between writes so that no byte is hashed twice
+type chunker struct {
+	buffer  []byte
+	scanned int
+	hash    uint64
+	emit    func(chunk []byte) error
+}
+
+func newChunker(emit func(chunk []byte) error) *chunker {
+	return &chunker{buffer: make([]byte, 0, 2*maxChunk), emit: emit}
+}
+
+func (c *chunker) Write(p []byte) (int, error) {
+	c.buffer = append(c.buffer, p...)
+	for {
+		n := c.boundary()
+		if n == 0 {
+			return len(p), nil
+		}
+		if err := c.emit(c.buffer[:n]); err != nil {
+			return len(p), err
+		}
+		c.buffer = append(c.buffer[:0], c.buffer[n:]...)
+	}
+}
+
+// flush emits the rest of the stream as the last chunk
+func (c *chunker) flush() error {
+	if len(c.buffer) == 0 {
+		return nil
+	}
+	err := c.emit(c.buffer)
+	c.buffer = c.buffer[:0]
+	c.scanned, c.hash = 0, 0
+	return err
+}
+
+// boundary returns the size of the first chunk of the buffer, 0 if more data is needed to tell
+func (c *chunker) boundary() int {
+	b := c.buffer
+	if len(b) <= minChunk {
+		return 0
+	}
+	end := len(b)
+	if end > maxChunk {
+		end = maxChunk
+	}
+	i := c.scanned
+	if i < minChunk {
+		i = minChunk
+	}
+	h := c.hash
+	for ; i < end; i++ {
+		h = h<<1 + gear[b[i]]
+		if h&chunkMask == 0 {
+			c.scanned, c.hash = 0, 0
+			return i + 1
+		}
+	}
+	if end == maxChunk {
+		c.scanned, c.hash = 0, 0
+		return maxChunk
+	}
+	c.scanned, c.hash = end, h
+	return 0
+}
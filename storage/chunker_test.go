@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// chunks splits b written in pieces of the size given
+func chunks(t *testing.T, b []byte, piece int) [][]byte {
+	t.Helper()
+	list := make([][]byte, 0)
+	c := newChunker(func(chunk []byte) error {
+		list = append(list, append([]byte{}, chunk...))
+		return nil
+	})
+	for len(b) > 0 {
+		n := piece
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := c.Write(b[:n]); err != nil {
+			t.Fatal(err)
+		}
+		b = b[n:]
+	}
+	if err := c.flush(); err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func sums(list [][]byte) map[[sha256.Size]byte]bool {
+	m := make(map[[sha256.Size]byte]bool)
+	for _, chunk := range list {
+		m[sha256.Sum256(chunk)] = true
+	}
+	return m
+}
+
+func TestChunkSizes(t *testing.T) {
+	for name, b := range map[string][]byte{
+		"random": data(40 << 20),
+		"zeros":  make([]byte, 20<<20),
+	} {
+		list := chunks(t, b, len(b))
+		if !bytes.Equal(bytes.Join(list, nil), b) {
+			t.Errorf("%s: chunks differ from the data", name)
+		}
+		for i, chunk := range list {
+			if len(chunk) > maxChunk || len(chunk) <= minChunk && i < len(list)-1 {
+				t.Errorf("%s: chunk %d of %d bytes", name, i, len(chunk))
+			}
+		}
+
+		// boundaries do not depend on how the data is written
+		for _, piece := range []int{4096, 100<<10 + 7, 3 << 20} {
+			other := chunks(t, b, piece)
+			if len(other) != len(list) {
+				t.Errorf("%s: %d chunks written by %d bytes, %d at once", name, len(other), piece, len(list))
+				continue
+			}
+			for i := range list {
+				if !bytes.Equal(other[i], list[i]) {
+					t.Errorf("%s: chunk %d differs written by %d bytes", name, i, piece)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestChunkInsert(t *testing.T) {
+	b := data(40 << 20)
+	// bytes inserted in the middle of the stream shift the rest of it
+	at := 17<<20 + 123
+	changed := append(append(append([]byte{}, b[:at]...), data(1000)...), b[at:]...)
+
+	before := chunks(t, b, 1<<20)
+	after := chunks(t, changed, 1<<20)
+	old := sums(before)
+	added := 0
+	for sum := range sums(after) {
+		if !old[sum] {
+			added++
+		}
+	}
+	// the boundaries after the insert are found again by the next chunk at the latest
+	if added > 2 {
+		t.Errorf("%d of %d chunks changed by an insert", added, len(after))
+	}
+	if len(before) < 5 {
+		t.Errorf("%d chunks, the stream is too short to tell", len(before))
+	}
+}
+
+func TestDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := NewDedup(dir)
+	if err := d.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := data(20 << 20)
+	at := 9 << 20
+	changed := append(append(append([]byte{}, b[:at]...), data(1000)...), b[at:]...)
+	write(t, d, "default/rbd/img@1", b)
+	write(t, d, "default/rbd/img@2", changed)
+	write(t, d, "empty", nil)
+
+	count := func() int {
+		n := 0
+		filepath.Walk(filepath.Join(dir, chunkDir), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+	// the second file only adds the chunks changed by the insert
+	stored := count()
+	if unique := len(sums(chunks(t, b, len(b)))); stored < unique || stored > unique+2 {
+		t.Errorf("%d chunks stored, %d in the first file", stored, unique)
+	}
+
+	for name, want := range map[string][]byte{"default/rbd/img@1": b, "default/rbd/img@2": changed, "empty": nil} {
+		if got := read(t, d, name); !bytes.Equal(got, want) {
+			t.Errorf("%s: read %d bytes differing from the %d written", name, len(got), len(want))
+		}
+		if size, err := d.Stat(name); err != nil || size != uint64(len(want)) {
+			t.Errorf("%s: size %d %v", name, size, err)
+		}
+	}
+
+	// nothing is pruned while every chunk is referred to
+	if result, err := d.Prune(); err != nil || result.Removed != 0 {
+		t.Errorf("prune: %+v %v", result, err)
+	}
+	if err := d.Remove("default/rbd/img@2"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := d.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Removed == 0 || result.Removed > 2 || stored-result.Removed != count() {
+		t.Errorf("prune removed %d of %d chunks, %d left", result.Removed, stored, count())
+	}
+	if got := read(t, d, "default/rbd/img@1"); !bytes.Equal(got, b) {
+		t.Error("file differs after prune")
+	}
+}
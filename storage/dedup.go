@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// files are manifests starting with this line followed by the sha256 and size of their chunks in order
+const manifestHeader = "rbd-backup-manifest v1"
+
+// chunks are stored by sha256 under this directory, in subdirectories named by the first byte
+const chunkDir = ".chunks"
+
+// Dedup keeps the files in a local directory as manifests of chunks, a chunk is stored
+// once however many files contain it. Removing a file leaves its chunks until Prune.
+type Dedup struct {
+	dir *Dir
+}
+
+func NewDedup(root string) *Dedup {
+	return &Dedup{NewDir(root)}
+}
+
+func (d *Dedup) Check() error {
+	return d.dir.Check()
+}
+
+type chunkRef struct {
+	sum  [sha256.Size]byte
+	size uint64
+}
+
+func (d *Dedup) chunkPath(sum [sha256.Size]byte) string {
+	s := hex.EncodeToString(sum[:])
+	return d.dir.Path(chunkDir + "/" + s[:2] + "/" + s)
+}
+
+type dedupFile struct {
+	d        *Dedup
+	manifest File
+	w        *bufio.Writer
+	chunker  *chunker
+}
+
+func (d *Dedup) Create(name string) (File, error) {
+	manifest, err := d.dir.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	f := &dedupFile{d: d, manifest: manifest, w: bufio.NewWriter(manifest)}
+	f.chunker = newChunker(f.store)
+	fmt.Fprintln(f.w, manifestHeader)
+	return f, nil
+}
+
+func (f *dedupFile) Write(p []byte) (int, error) {
+	return f.chunker.Write(p)
+}
+
+// store writes the chunk unless it is stored already and adds it to the manifest
+func (f *dedupFile) store(chunk []byte) error {
+	sum := sha256.Sum256(chunk)
+	path := f.d.chunkPath(sum)
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		err = writeChunk(path, chunk)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f.w, "%x %d\n", sum, len(chunk))
+	return err
+}
+
+// writeChunk writes the chunk aside and renames it so that a stored chunk is always complete
+func writeChunk(path string, chunk []byte) error {
+	dir := path[:strings.LastIndex(path, "/")]
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(chunk)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (f *dedupFile) Close() error {
+	err := f.chunker.flush()
+	if err == nil {
+		err = f.w.Flush()
+	}
+	if err != nil {
+		f.manifest.Abort()
+		return err
+	}
+	return f.manifest.Close()
+}
+
+func (f *dedupFile) Abort() error {
+	return f.manifest.Abort()
+}
+
+// manifest returns the chunks of file name and its size
+func (d *Dedup) manifest(name string) ([]chunkRef, uint64, error) {
+	r, _, err := d.dir.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() || scanner.Text() != manifestHeader {
+		if err := scanner.Err(); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, errors.New(name + " is not a manifest of chunks")
+	}
+	chunks := make([]chunkRef, 0)
+	size := uint64(0)
+	for scanner.Scan() {
+		var s string
+		var c chunkRef
+		if _, err := fmt.Sscanf(scanner.Text(), "%s %d", &s, &c.size); err != nil {
+			return nil, 0, errors.New("invalid manifest " + name + ": " + err.Error())
+		}
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != sha256.Size {
+			return nil, 0, errors.New("invalid chunk " + s + " in manifest " + name)
+		}
+		copy(c.sum[:], b)
+		chunks = append(chunks, c)
+		size += c.size
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return chunks, size, nil
+}
+
+// chunkReader reads the chunks of a manifest in order, each one is verified against its sha256
+type chunkReader struct {
+	d      *Dedup
+	chunks []chunkRef
+	data   []byte
+}
+
+func (d *Dedup) Open(name string) (io.ReadCloser, uint64, error) {
+	chunks, size, err := d.manifest(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &chunkReader{d: d, chunks: chunks}, size, nil
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		c := r.chunks[0]
+		r.chunks = r.chunks[1:]
+		data, err := ioutil.ReadFile(r.d.chunkPath(c.sum))
+		if err != nil {
+			return 0, err
+		}
+		if sum := sha256.Sum256(data); uint64(len(data)) != c.size || !bytes.Equal(sum[:], c.sum[:]) {
+			return 0, errors.New("chunk " + hex.EncodeToString(c.sum[:]) + " is corrupted")
+		}
+		r.data = data
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *chunkReader) Close() error {
+	return nil
+}
+
+func (d *Dedup) Stat(name string) (uint64, error) {
+	_, size, err := d.manifest(name)
+	return size, err
+}
+
+func (d *Dedup) Remove(name string) error {
+	return d.dir.Remove(name)
+}
+
+func (d *Dedup) List() ([]string, error) {
+	return d.dir.List()
+}
+
+func (d *Dedup) Space() (uint64, uint64, error) {
+	return d.dir.Space()
+}
+
+// Prune removes the chunks no manifest refers to. Chunks written by a backup which
+// is still running are not referred to yet, so it must not run at the same time.
+func (d *Dedup) Prune() (PruneResult, error) {
+	result := PruneResult{}
+	names, err := d.List()
+	if err != nil {
+		return result, err
+	}
+	used := make(map[[sha256.Size]byte]bool)
+	for _, name := range names {
+		chunks, _, err := d.manifest(name)
+		if err != nil {
+			// better keep garbage than lose the chunks of an unreadable manifest
+			return result, err
+		}
+		for _, c := range chunks {
+			used[c.sum] = true
+		}
+	}
+
+	root := d.dir.Path(chunkDir)
+	dirs, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(root + "/" + dir.Name())
+		if err != nil {
+			return result, err
+		}
+		for _, f := range files {
+			var sum [sha256.Size]byte
+			b, err := hex.DecodeString(f.Name())
+			if err != nil || len(b) != sha256.Size {
+				continue
+			}
+			copy(sum[:], b)
+			if used[sum] {
+				continue
+			}
+			if err := os.Remove(root + "/" + dir.Name() + "/" + f.Name()); err != nil {
+				return result, err
+			}
+			result.Removed++
+			result.Freed += uint64(f.Size())
+		}
+	}
+	return result, nil
+}
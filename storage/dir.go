@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Dir keeps the files in a local directory. Files are written under a hidden
+// name and renamed when complete, names starting with '.' are not listed.
+type Dir struct {
+	root string
+}
+
+func NewDir(root string) *Dir {
+	return &Dir{root}
+}
+
+// Check makes sure the directory exists
+func (d *Dir) Check() error {
+	f, err := os.Stat(d.root)
+	if err != nil {
+		return err
+	}
+	if !f.IsDir() {
+		return errors.New("path " + d.root + " is not directory")
+	}
+	return nil
+}
+
+func (d *Dir) Path(name string) string {
+	return d.root + "/" + name
+}
+
+// dirFile is seekable so that holes of images are kept sparse
+type dirFile struct {
+	*os.File
+	path string
+}
+
+func (d *Dir) Create(name string) (File, error) {
+	if err := os.MkdirAll(filepath.Dir(d.Path(name)), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(d.Path(partialName(name)))
+	if err != nil {
+		return nil, err
+	}
+	return &dirFile{f, d.Path(name)}, nil
+}
+
+func (f *dirFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), f.path)
+}
+
+func (f *dirFile) Abort() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+func (d *Dir) Open(name string) (io.ReadCloser, uint64, error) {
+	f, err := os.Open(d.Path(name))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, uint64(info.Size()), nil
+}
+
+func (d *Dir) Stat(name string) (uint64, error) {
+	info, err := os.Stat(d.Path(name))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(info.Size()), nil
+}
+
+func (d *Dir) Remove(name string) error {
+	return os.Remove(d.Path(name))
+}
+
+func (d *Dir) List() ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.Walk(d.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		hidden := path != d.root && strings.HasPrefix(info.Name(), ".")
+		switch {
+		case info.IsDir() && hidden:
+			return filepath.SkipDir
+		case info.IsDir() || hidden:
+			return nil
+		}
+		name, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(name))
+		return nil
+	})
+	return files, err
+}
+
+func (d *Dir) Space() (uint64, uint64, error) {
+	fs := syscall.Statfs_t{}
+	if err := syscall.Statfs(d.root, &fs); err != nil {
+		return 0, 0, err
+	}
+	free := fs.Bfree * uint64(fs.Bsize)
+	total := fs.Blocks * uint64(fs.Bsize)
+	return free, total, nil
+}
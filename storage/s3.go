@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// DefaultPartSize is the size of the parts of multipart uploads, one part is
+	// buffered in memory per backup being written
+	DefaultPartSize = 16 << 20
+	// MinPartSize is the smallest part size S3 accepts
+	MinPartSize = 5 << 20
+	// MaxPartSize is the largest part size S3 accepts
+	MaxPartSize = 5 << 30
+	// MaxParts is the most parts an object may have
+	MaxParts = 10000
+)
+
+type S3Config struct {
+	Endpoint  string `json:"endpoint"` // host and port, such as s3.amazonaws.com or localhost:9000
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix,omitempty"` // files are stored under prefix/ if set
+	Region    string `json:"region,omitempty"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Insecure  bool   `json:"insecure,omitempty"` // plain http instead of https
+	// PartSize is DefaultPartSize if 0. Objects have at most MaxParts parts, so files of
+	// unknown size are at most 10000 times PartSize, 156 GiB by default. Files whose size
+	// is known when they are created, such as backups of images, get parts large enough
+	// for it, up to the 5 TiB S3 allows for an object.
+	PartSize uint64 `json:"part_size,omitempty"`
+}
+
+// Validate checks the settings without connecting
+func (cfg *S3Config) Validate() error {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return errors.New("s3 endpoint and bucket are required")
+	}
+	if strings.Contains(cfg.Endpoint, "/") {
+		return errors.New("s3 endpoint must be a host and port, not an url")
+	}
+	if cfg.PartSize != 0 && cfg.PartSize < MinPartSize {
+		return errors.New("s3 part size must be at least 5 MiB")
+	}
+	if cfg.PartSize > MaxPartSize {
+		return errors.New("s3 part size must be at most 5 GiB")
+	}
+	return nil
+}
+
+// S3 keeps the files as objects of a bucket of S3 or of a compatible object storage.
+// Files are uploaded in parts whose MD5 and SHA-256 are checked by the server, the SHA-256
+// only over https as plain http uploads are signed chunk by chunk instead.
+type S3 struct {
+	cfg    S3Config
+	prefix string
+	core   *minio.Core
+}
+
+func NewS3(cfg S3Config) (*S3, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	client, err := minio.NewWithOptions(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: !cfg.Insecure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = DefaultPartSize
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3{cfg: cfg, prefix: prefix, core: &minio.Core{Client: client}}, nil
+}
+
+// Check makes sure the bucket exists and the credentials give access to it
+func (s *S3) Check() error {
+	ok, err := s.core.BucketExists(s.cfg.Bucket)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("bucket " + s.cfg.Bucket + " does not exist")
+	}
+	return nil
+}
+
+func (s *S3) key(name string) string {
+	return s.prefix + name
+}
+
+// notExist makes the error of a missing object satisfy os.IsNotExist
+func (s *S3) notExist(name string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return &os.PathError{Op: "stat", Path: s.cfg.Bucket + "/" + s.key(name), Err: os.ErrNotExist}
+	}
+	return err
+}
+
+// s3File buffers a part and uploads it once full. The multipart upload is only started
+// with the second part, smaller files are uploaded as a single object on Close.
+type s3File struct {
+	s        *S3
+	key      string
+	buffer   []byte
+	uploadId string
+	parts    []minio.CompletePart
+}
+
+func (s *S3) Create(name string) (File, error) {
+	return s.CreateSized(name, 0)
+}
+
+// CreateSized makes the parts large enough for a file of size bytes to fit in MaxParts,
+// with room for the overhead of compression, encryption and diff records
+func (s *S3) CreateSized(name string, size uint64) (File, error) {
+	return &s3File{s: s, key: s.key(name), buffer: make([]byte, 0, partSize(s.cfg.PartSize, size))}, nil
+}
+
+// partSize returns the size of the parts of a file of size bytes, at least min
+func partSize(min uint64, size uint64) uint64 {
+	size += size / 16
+	part := (size + MaxParts - 1) / MaxParts
+	// whole MiB
+	part = (part + 1<<20 - 1) &^ (1<<20 - 1)
+	if part < min {
+		return min
+	}
+	if part > MaxPartSize {
+		return MaxPartSize
+	}
+	return part
+}
+
+func (f *s3File) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := cap(f.buffer) - len(f.buffer)
+		if n > len(p) {
+			n = len(p)
+		}
+		f.buffer = append(f.buffer, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(f.buffer) == cap(f.buffer) {
+			if err := f.upload(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// checksums returns the MD5 and SHA-256 of b as sent along with it
+func checksums(b []byte) (string, string) {
+	md5sum := md5.Sum(b)
+	sha256sum := sha256.Sum256(b)
+	return base64.StdEncoding.EncodeToString(md5sum[:]), hex.EncodeToString(sha256sum[:])
+}
+
+// upload sends the buffer as the next part
+func (f *s3File) upload() error {
+	s := f.s
+	number := len(f.parts) + 1
+	if number > MaxParts {
+		return fmt.Errorf("file %s is larger than %d parts of %d bytes allowed by s3, its size should be given when it is created", f.key, MaxParts, cap(f.buffer))
+	}
+	if f.uploadId == "" {
+		id, err := s.core.NewMultipartUpload(s.cfg.Bucket, f.key, minio.PutObjectOptions{})
+		if err != nil {
+			return err
+		}
+		f.uploadId = id
+	}
+	md5sum, sha256sum := checksums(f.buffer)
+	part, err := s.core.PutObjectPart(s.cfg.Bucket, f.key, f.uploadId, number, bytes.NewReader(f.buffer), int64(len(f.buffer)), md5sum, sha256sum, nil)
+	if err != nil {
+		return err
+	}
+	f.parts = append(f.parts, minio.CompletePart{PartNumber: number, ETag: part.ETag})
+	f.buffer = f.buffer[:0]
+	return nil
+}
+
+func (f *s3File) Close() error {
+	s := f.s
+	if f.uploadId == "" {
+		md5sum, sha256sum := checksums(f.buffer)
+		_, err := s.core.PutObject(s.cfg.Bucket, f.key, bytes.NewReader(f.buffer), int64(len(f.buffer)), md5sum, sha256sum, nil, nil)
+		return err
+	}
+	if len(f.buffer) > 0 {
+		if err := f.upload(); err != nil {
+			f.Abort()
+			return err
+		}
+	}
+	if _, err := s.core.CompleteMultipartUpload(s.cfg.Bucket, f.key, f.uploadId, f.parts); err != nil {
+		f.Abort()
+		return err
+	}
+	return nil
+}
+
+// Abort drops the uploaded parts, the ones of uploads interrupted by a crash are
+// left to the lifecycle rules of the bucket
+func (f *s3File) Abort() error {
+	if f.uploadId == "" {
+		return nil
+	}
+	return f.s.core.AbortMultipartUpload(f.s.cfg.Bucket, f.key, f.uploadId)
+}
+
+func (s *S3) Open(name string) (io.ReadCloser, uint64, error) {
+	r, info, err := s.core.GetObject(s.cfg.Bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, 0, s.notExist(name, err)
+	}
+	return r, uint64(info.Size), nil
+}
+
+func (s *S3) Stat(name string) (uint64, error) {
+	info, err := s.core.StatObject(s.cfg.Bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return 0, s.notExist(name, err)
+	}
+	return uint64(info.Size), nil
+}
+
+func (s *S3) Remove(name string) error {
+	return s.core.RemoveObject(s.cfg.Bucket, s.key(name))
+}
+
+func (s *S3) List() ([]string, error) {
+	done := make(chan struct{})
+	defer close(done)
+	files := make([]string, 0)
+	for object := range s.core.Client.ListObjectsV2(s.cfg.Bucket, s.prefix, true, done) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		name := strings.TrimPrefix(object.Key, s.prefix)
+		if name == "" || strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		files = append(files, name)
+	}
+	return files, nil
+}
+
+// Space is unknown for buckets, they have no fixed size
+func (s *S3) Space() (uint64, uint64, error) {
+	return 0, 0, nil
+}
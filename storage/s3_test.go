@@ -0,0 +1,442 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"github.com/minio/minio-go"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory stand-in for the part of the S3 API used by S3, it
+// rejects uploads whose Content-MD5 or x-amz-content-sha256 is missing or wrong
+type fakeS3 struct {
+	bucket string
+
+	mutex   sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	puts    int // objects uploaded in a single request
+	parts   int
+	aborted int
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{bucket: bucket, objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+	// minio-go only sends the SHA-256 of the payload over https
+	srv := httptest.NewTLSServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+}
+
+// checked reads the body and verifies it against the checksums sent along with it
+func checked(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s3Error(w, http.StatusBadRequest, "IncompleteBody")
+		return nil, false
+	}
+	md5sum := md5.Sum(b)
+	sha256sum := sha256.Sum256(b)
+	if r.Header.Get("Content-Md5") != base64.StdEncoding.EncodeToString(md5sum[:]) {
+		s3Error(w, http.StatusBadRequest, "BadDigest")
+		return nil, false
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sha256sum[:]) {
+		s3Error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+		return nil, false
+	}
+	return b, true
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key := name, ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		bucket, key = name[:i], name[i+1:]
+	}
+	if bucket != f.bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	uploadId := query.Get("uploadId")
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, query.Get("prefix"))
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		uploadId = strconv.Itoa(len(f.uploads)+1) + "-" + key
+		f.uploads[uploadId] = map[int][]byte{}
+		xml.NewEncoder(w).Encode(struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: uploadId})
+	case r.Method == http.MethodPut && uploadId != "":
+		parts, ok := f.uploads[uploadId]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		b, ok := checked(w, r)
+		if !ok {
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = b
+		f.parts++
+		w.Header().Set("ETag", `"`+strconv.Itoa(number)+`"`)
+	case r.Method == http.MethodPost && uploadId != "":
+		parts, ok := f.uploads[uploadId]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		complete := struct {
+			Part []struct{ PartNumber int }
+		}{}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			s3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var object []byte
+		for _, part := range complete.Part {
+			object = append(object, parts[part.PartNumber]...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, uploadId)
+		xml.NewEncoder(w).Encode(struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"complete"`})
+	case r.Method == http.MethodDelete && uploadId != "":
+		if _, ok := f.uploads[uploadId]; !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		delete(f.uploads, uploadId)
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		b, ok := checked(w, r)
+		if !ok {
+			return
+		}
+		f.objects[key] = b
+		f.puts++
+		w.Header().Set("ETag", `"object"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		b, ok := f.objects[key]
+		if !ok {
+			// a HEAD response has no body, the client tells the code from the status
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"object"`)
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key  string
+		Size int
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		IsTruncated bool
+		Contents    []content
+	}{Name: f.bucket, Prefix: prefix}
+	for key, b := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{key, len(b)})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newTestS3(t *testing.T, prefix string) (*S3, *fakeS3) {
+	f, srv := newFakeS3(t, "backups")
+	s, err := NewS3(S3Config{
+		Endpoint:  strings.TrimPrefix(srv.URL, "https://"),
+		Bucket:    "backups",
+		Prefix:    prefix,
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PartSize:  MinPartSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.core.Client.SetCustomTransport(srv.Client().Transport)
+	if err := s.Check(); err != nil {
+		t.Fatal(err)
+	}
+	return s, f
+}
+
+func data(size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(b)
+	return b
+}
+
+func write(t *testing.T, s Storage, name string, b []byte) {
+	t.Helper()
+	w, err := s.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(t *testing.T, s Storage, name string) []byte {
+	t.Helper()
+	r, size, err := s.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != uint64(len(b)) {
+		t.Errorf("%s: size %d, read %d bytes", name, size, len(b))
+	}
+	return b
+}
+
+func TestS3SinglePut(t *testing.T) {
+	s, f := newTestS3(t, "")
+	b := data(1000)
+	write(t, s, "img@1", b)
+	if f.puts != 1 || f.parts != 0 {
+		t.Errorf("%d puts and %d parts, want a single put", f.puts, f.parts)
+	}
+	if !bytes.Equal(f.objects["img@1"], b) {
+		t.Error("stored object differs")
+	}
+	if got := read(t, s, "img@1"); !bytes.Equal(got, b) {
+		t.Error("read object differs")
+	}
+
+	// an empty file is an empty object
+	write(t, s, "empty", nil)
+	if size, err := s.Stat("empty"); err != nil || size != 0 {
+		t.Errorf("empty object: %d %v", size, err)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	s, f := newTestS3(t, "")
+	b := data(2*MinPartSize + 100)
+	w, err := s.Create("img@1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writes smaller than a part are buffered
+	for p := b; len(p) > 0; {
+		n := 1 << 20
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if f.puts != 0 || f.parts != 3 {
+		t.Errorf("%d puts and %d parts, want 3 parts", f.puts, f.parts)
+	}
+	if len(f.uploads) != 0 {
+		t.Errorf("%d uploads left", len(f.uploads))
+	}
+	if got := read(t, s, "img@1"); !bytes.Equal(got, b) {
+		t.Errorf("object of %d bytes differs from the %d written", len(got), len(b))
+	}
+}
+
+func TestS3Abort(t *testing.T) {
+	s, f := newTestS3(t, "")
+	w, err := s.Create("img@1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data(MinPartSize + 10)); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.uploads) != 1 || f.parts != 1 {
+		t.Fatalf("%d uploads with %d parts, want one started", len(f.uploads), f.parts)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.uploads) != 0 || f.aborted != 1 {
+		t.Errorf("%d uploads left, %d aborted", len(f.uploads), f.aborted)
+	}
+	if _, err := s.Stat("img@1"); !os.IsNotExist(err) {
+		t.Errorf("stat of aborted file: %v", err)
+	}
+
+	// a file never uploaded has nothing to abort
+	w, err = s.Create("img@2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data(10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if f.puts != 0 || len(f.objects) != 0 {
+		t.Errorf("%d puts, %d objects after abort", f.puts, len(f.objects))
+	}
+}
+
+func TestS3Prefix(t *testing.T) {
+	s, f := newTestS3(t, "/ceph/")
+	f.objects["other/img@1"] = data(5)
+	f.objects["ceph/.partial"] = data(5)
+	write(t, s, "default/rbd/img@1", data(10))
+	write(t, s, "default/rbd/img@1_to_2.diff", data(20))
+	write(t, s, "top", data(30))
+
+	if _, ok := f.objects["ceph/default/rbd/img@1"]; !ok {
+		t.Error("object not stored under the prefix")
+	}
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(list)
+	if want := []string{"default/rbd/img@1", "default/rbd/img@1_to_2.diff", "top"}; !reflect.DeepEqual(list, want) {
+		t.Errorf("list %v, want %v", list, want)
+	}
+
+	if size, err := s.Stat("default/rbd/img@1_to_2.diff"); err != nil || size != 20 {
+		t.Errorf("stat: %d %v", size, err)
+	}
+	if got := read(t, s, "top"); !bytes.Equal(got, data(30)) {
+		t.Error("read object differs")
+	}
+	if _, err := s.Stat("img@1"); !os.IsNotExist(err) {
+		t.Errorf("stat of missing file: %v", err)
+	}
+	if _, _, err := s.Open("img@1"); !os.IsNotExist(err) {
+		t.Errorf("open of missing file: %v", err)
+	}
+
+	if err := s.Remove("default/rbd/img@1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.objects["ceph/default/rbd/img@1"]; ok {
+		t.Error("removed object is kept")
+	}
+	if _, ok := f.objects["other/img@1"]; !ok {
+		t.Error("object outside the prefix is removed")
+	}
+	if _, err := s.Stat("default/rbd/img@1"); !os.IsNotExist(err) {
+		t.Errorf("stat of removed file: %v", err)
+	}
+}
+
+func TestPartSize(t *testing.T) {
+	tests := []struct {
+		min  uint64
+		size uint64
+		want uint64
+	}{
+		{DefaultPartSize, 0, DefaultPartSize},
+		{DefaultPartSize, 100 << 30, DefaultPartSize},
+		{MinPartSize, 100 << 30, 11 << 20},
+		{DefaultPartSize, 1 << 40, 112 << 20},
+		{DefaultPartSize, 5 << 40, 558 << 20},
+		{DefaultPartSize, 100 << 40, MaxPartSize},
+	}
+	for _, test := range tests {
+		got := partSize(test.min, test.size)
+		if got != test.want {
+			t.Errorf("part size of %d bytes at least %d: %d, want %d", test.size, test.min, got, test.want)
+		}
+		// the file and the overhead allowed fit in the parts
+		if got < MaxPartSize && got*MaxParts < test.size+test.size/16 {
+			t.Errorf("%d bytes do not fit in parts of %d", test.size, got)
+		}
+	}
+}
+
+func TestS3TooManyParts(t *testing.T) {
+	s, f := newTestS3(t, "")
+	w, err := s.CreateSized("img@1", 1<<40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := w.(*s3File)
+	if n := cap(file.buffer); n != 112<<20 {
+		t.Errorf("part size %d for a file of 1 TiB", n)
+	}
+
+	// the part after the last one allowed is refused before it is uploaded
+	file.buffer = make([]byte, 0, 10)
+	file.uploadId = "1-img@1"
+	file.parts = make([]minio.CompletePart, MaxParts)
+	if _, err := w.Write(data(10)); err == nil {
+		t.Error("part beyond the limit is written")
+	}
+	if f.parts != 0 {
+		t.Errorf("%d parts uploaded", f.parts)
+	}
+}
@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SFTPConfig struct {
+	Host       string `json:"host"`
+	Port       int    `json:"port,omitempty"` // 22 if 0
+	User       string `json:"user"`
+	Key        string `json:"key"`                   // file of the private key, it must not have a passphrase
+	KnownHosts string `json:"known_hosts,omitempty"` // ~/.ssh/known_hosts if empty
+	Path       string `json:"path"`                  // remote directory of the files
+}
+
+// Validate checks the settings without connecting
+func (cfg *SFTPConfig) Validate() error {
+	if cfg.Host == "" || cfg.User == "" || cfg.Key == "" || cfg.Path == "" {
+		return errors.New("sftp host, user, key and path are required")
+	}
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return errors.New("invalid sftp port " + strconv.Itoa(cfg.Port))
+	}
+	return nil
+}
+
+func (cfg *SFTPConfig) address() string {
+	port := cfg.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(cfg.Host, strconv.Itoa(port))
+}
+
+func (cfg *SFTPConfig) knownHosts() string {
+	if cfg.KnownHosts != "" {
+		return cfg.KnownHosts
+	}
+	return os.Getenv("HOME") + "/.ssh/known_hosts"
+}
+
+// clientConfig reads the key and the known hosts, host keys are always verified
+func (cfg *SFTPConfig) clientConfig() (*ssh.ClientConfig, error) {
+	pem, err := ioutil.ReadFile(cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, errors.New("invalid key " + cfg.Key + ": " + err.Error())
+	}
+	hostKey, err := knownhosts.New(cfg.knownHosts())
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKey,
+		Timeout:         10 * time.Second,
+	}, nil
+}
+
+// connected clients by user, address and key, a client is dropped once its connection is closed
+var (
+	sftpMutex   sync.Mutex
+	sftpClients = make(map[string]*sftp.Client)
+)
+
+// a connection whose server does not answer a keepalive in time is closed, otherwise
+// a half-open connection hangs every job using the cached client, set with sftpMutex
+var (
+	sftpKeepalive        = 30 * time.Second
+	sftpKeepaliveTimeout = 15 * time.Second
+)
+
+// SFTP keeps the files in a directory of a remote host reached over SSH. Like Dir,
+// files are written under a hidden name and renamed when complete.
+type SFTP struct {
+	cfg SFTPConfig
+}
+
+func NewSFTP(cfg SFTPConfig) (*SFTP, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.Path = strings.TrimSuffix(cfg.Path, "/")
+	return &SFTP{cfg}, nil
+}
+
+// client returns the connected client of the host, it connects if there is none
+func (s *SFTP) client() (*sftp.Client, error) {
+	id := s.cfg.User + "@" + s.cfg.address() + " " + s.cfg.Key
+	sftpMutex.Lock()
+	defer sftpMutex.Unlock()
+	if c, ok := sftpClients[id]; ok {
+		return c, nil
+	}
+
+	config, err := s.cfg.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ssh.Dial("tcp", s.cfg.address(), config)
+	if err != nil {
+		return nil, err
+	}
+	c, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sftpClients[id] = c
+	done := make(chan struct{})
+	go keepalive(conn, done, sftpKeepalive, sftpKeepaliveTimeout)
+	go func() {
+		conn.Wait()
+		close(done)
+		sftpMutex.Lock()
+		if sftpClients[id] == c {
+			delete(sftpClients, id)
+		}
+		sftpMutex.Unlock()
+		c.Close()
+	}()
+	return c, nil
+}
+
+func keepalive(conn *ssh.Client, done chan struct{}, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		reply := make(chan error, 1)
+		go func() {
+			// any reply will do, servers refuse requests they do not know
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case err := <-reply:
+			if err == nil {
+				continue
+			}
+		case <-time.After(timeout):
+		}
+		conn.Close()
+		return
+	}
+}
+
+func (s *SFTP) path(name string) string {
+	return s.cfg.Path + "/" + name
+}
+
+// Check makes sure the remote directory exists and the server has the extensions
+// used to rename complete files and to get the free space
+func (s *SFTP) Check() error {
+	c, err := s.client()
+	if err != nil {
+		return err
+	}
+	for _, ext := range []string{"posix-rename@openssh.com", "statvfs@openssh.com"} {
+		if _, ok := c.HasExtension(ext); !ok {
+			return errors.New("sftp server " + s.cfg.Host + " does not support " + ext)
+		}
+	}
+	f, err := c.Stat(s.cfg.Path)
+	if err != nil {
+		return err
+	}
+	if !f.IsDir() {
+		return errors.New("path " + s.cfg.Path + " is not directory")
+	}
+	return nil
+}
+
+// sftpFile is seekable so that holes of images are kept sparse
+type sftpFile struct {
+	*sftp.File
+	c    *sftp.Client
+	path string
+}
+
+func (s *SFTP) Create(name string) (File, error) {
+	c, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.MkdirAll(path.Dir(s.path(name))); err != nil {
+		return nil, err
+	}
+	f, err := c.Create(s.path(partialName(name)))
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFile{f, c, s.path(name)}, nil
+}
+
+func (f *sftpFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		f.c.Remove(f.Name())
+		return err
+	}
+	// plain rename fails if the file exists
+	return f.c.PosixRename(f.Name(), f.path)
+}
+
+func (f *sftpFile) Abort() error {
+	f.File.Close()
+	return f.c.Remove(f.Name())
+}
+
+// sftpReader reads ahead so that reads are sent as concurrent requests
+type sftpReader struct {
+	*bufio.Reader
+	f *sftp.File
+}
+
+func (r *sftpReader) Close() error {
+	return r.f.Close()
+}
+
+func (s *SFTP) Open(name string) (io.ReadCloser, uint64, error) {
+	c, err := s.client()
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := c.Open(s.path(name))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return &sftpReader{bufio.NewReaderSize(f, 1<<20), f}, uint64(info.Size()), nil
+}
+
+func (s *SFTP) Stat(name string) (uint64, error) {
+	c, err := s.client()
+	if err != nil {
+		return 0, err
+	}
+	info, err := c.Stat(s.path(name))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(info.Size()), nil
+}
+
+func (s *SFTP) Remove(name string) error {
+	c, err := s.client()
+	if err != nil {
+		return err
+	}
+	return c.Remove(s.path(name))
+}
+
+func (s *SFTP) List() ([]string, error) {
+	c, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0)
+	walker := c.Walk(s.cfg.Path)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+		info := walker.Stat()
+		hidden := walker.Path() != s.cfg.Path && strings.HasPrefix(info.Name(), ".")
+		switch {
+		case info.IsDir() && hidden:
+			walker.SkipDir()
+		case !info.IsDir() && !hidden:
+			files = append(files, strings.TrimPrefix(walker.Path(), s.cfg.Path+"/"))
+		}
+	}
+	return files, nil
+}
+
+// Space asks the server with the statvfs@openssh.com extension
+func (s *SFTP) Space() (uint64, uint64, error) {
+	c, err := s.client()
+	if err != nil {
+		return 0, 0, err
+	}
+	vfs, err := c.StatVFS(s.cfg.Path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return vfs.FreeSpace(), vfs.TotalSpace(), nil
+}
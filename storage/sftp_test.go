@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sshServer serves the sftp subsystem of the local filesystem to the holder of one key
+type sshServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	mutex sync.Mutex
+	conns []ssh.Conn
+	mute  bool // global requests such as keepalives are left unanswered
+}
+
+func generateKey(t *testing.T) (*ecdsa.PrivateKey, ssh.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, signer
+}
+
+// newTestSFTP starts a server on a local port and returns the storage of a temporary
+// directory, the key of the client and the known hosts are written next to it
+func newTestSFTP(t *testing.T) (*SFTP, *sshServer, string) {
+	dir, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	root := filepath.Join(dir, "backups")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	userKey, user := generateKey(t)
+	_, host := generateKey(t)
+	srv := &sshServer{config: &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() != "backup" || !bytes.Equal(key.Marshal(), user.PublicKey().Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}}
+	srv.config.AddHostKey(host)
+	if srv.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.close)
+	go srv.serve()
+
+	der, err := x509.MarshalECPrivateKey(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ecdsa")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	address := srv.listener.Addr().(*net.TCPAddr)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address.String())}, host.PublicKey())
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewSFTP(SFTPConfig{
+		Host:       "127.0.0.1",
+		Port:       address.Port,
+		User:       "backup",
+		Key:        keyFile,
+		KnownHosts: knownHosts,
+		Path:       root + "/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Check(); err != nil {
+		t.Fatal(err)
+	}
+	return s, srv, root
+}
+
+func (srv *sshServer) serve() {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		go srv.handle(conn)
+	}
+}
+
+func (srv *sshServer) handle(conn net.Conn) {
+	sconn, channels, requests, err := ssh.NewServerConn(conn, srv.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	srv.mutex.Lock()
+	srv.conns = append(srv.conns, sconn)
+	srv.mutex.Unlock()
+	go func() {
+		for req := range requests {
+			srv.mutex.Lock()
+			mute := srv.mute
+			srv.mutex.Unlock()
+			if !mute && req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+	for ch := range channels {
+		if ch.ChannelType() != "session" {
+			ch.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, reqs, err := ch.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer channel.Close()
+			for req := range reqs {
+				// the payload of a subsystem request is the name as an ssh string
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					return
+				}
+				server.Serve()
+				server.Close()
+				return
+			}
+		}()
+	}
+}
+
+func (srv *sshServer) close() {
+	srv.listener.Close()
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	for _, conn := range srv.conns {
+		conn.Close()
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	s, _, root := newTestSFTP(t)
+
+	b := data(3<<20 + 17)
+	write(t, s, "default/rbd/img@1", b)
+	write(t, s, "default/rbd/img@2", data(1000))
+	write(t, s, "empty", nil)
+	// complete files are renamed over older ones
+	write(t, s, "default/rbd/img@2", nil)
+	if got := read(t, s, "default/rbd/img@1"); !bytes.Equal(got, b) {
+		t.Errorf("read %d bytes differing from the %d written", len(got), len(b))
+	}
+	if size, err := s.Stat("default/rbd/img@2"); err != nil || size != 0 {
+		t.Errorf("overwritten file: size %d %v", size, err)
+	}
+
+	// a file is not there until it is closed
+	f, err := s.Create("default/rbd/img@3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("default/rbd/img@3"); !os.IsNotExist(err) {
+		t.Errorf("stat of a partial file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "default/rbd/.img@3.partial")); err != nil {
+		t.Error(err)
+	}
+	files, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	if want := []string{"default/rbd/img@1", "default/rbd/img@2", "empty"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("list %v, want %v", files, want)
+	}
+	if err := f.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "default/rbd/.img@3.partial")); !os.IsNotExist(err) {
+		t.Errorf("partial file after abort: %v", err)
+	}
+
+	if err := s.Remove("empty"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Open("empty"); !os.IsNotExist(err) {
+		t.Errorf("open of a removed file: %v", err)
+	}
+
+	free, total, err := s.Space()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total == 0 || free > total {
+		t.Errorf("free %d of %d bytes", free, total)
+	}
+}
+
+func TestSFTPKeepalive(t *testing.T) {
+	sftpMutex.Lock()
+	interval, timeout := sftpKeepalive, sftpKeepaliveTimeout
+	sftpKeepalive, sftpKeepaliveTimeout = 100*time.Millisecond, 200*time.Millisecond
+	sftpMutex.Unlock()
+	defer func() {
+		sftpMutex.Lock()
+		sftpKeepalive, sftpKeepaliveTimeout = interval, timeout
+		sftpMutex.Unlock()
+	}()
+
+	s, srv, _ := newTestSFTP(t)
+	c, err := s.client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// answered keepalives keep the client
+	time.Sleep(500 * time.Millisecond)
+	if other, err := s.client(); err != nil || other != c {
+		t.Fatalf("client replaced while the server answers: %v", err)
+	}
+
+	// a server that stops answering looks like a half-open connection
+	srv.mutex.Lock()
+	srv.mute = true
+	srv.mutex.Unlock()
+	id := s.cfg.User + "@" + s.cfg.address() + " " + s.cfg.Key
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		sftpMutex.Lock()
+		_, ok := sftpClients[id]
+		sftpMutex.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client kept after keepalives went unanswered")
+		}
+	}
+
+	srv.mutex.Lock()
+	srv.mute = false
+	srv.mutex.Unlock()
+	if _, err := s.Stat("missing"); !os.IsNotExist(err) {
+		t.Errorf("stat after reconnecting: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"io"
+	"path"
+)
+
+// Storage keeps the backup files of a repository, files are named relative to the repository
+// and may be in directories separated by '/'
+type Storage interface {
+	// Create starts writing a file, it replaces the file of the same name once
+	// closed without error and is discarded by Abort
+	Create(name string) (File, error)
+	// Open reads a file and returns its size
+	Open(name string) (io.ReadCloser, uint64, error)
+	// Stat returns the size of a file, the error satisfies os.IsNotExist if there is none
+	Stat(name string) (uint64, error)
+	Remove(name string) error
+	// List returns the files in all directories, names starting with '.' are not listed
+	List() ([]string, error)
+	// Space returns the free and total bytes
+	Space() (uint64, uint64, error)
+}
+
+// SizedCreator is implemented by storages which lay a file out by the size it is going
+// to have, such as the parts of an object
+type SizedCreator interface {
+	// CreateSized is Create of a file expected to be about size bytes, 0 if unknown
+	CreateSized(name string, size uint64) (File, error)
+}
+
+// CreateSized creates a file expected to be about size bytes, the storages which do not
+// need to know create it as any other
+func CreateSized(st Storage, name string, size uint64) (File, error) {
+	if sc, ok := st.(SizedCreator); ok {
+		return sc.CreateSized(name, size)
+	}
+	return st.Create(name)
+}
+
+// partialName is the hidden name a file is written under until it is complete
+func partialName(name string) string {
+	return path.Join(path.Dir(name), "."+path.Base(name)+".partial")
+}
+
+// File is a file being written
+type File interface {
+	io.Writer
+	Close() error
+	Abort() error
+}
+
+// Local is implemented by storages whose files can be read directly from the local file system
+type Local interface {
+	Path(name string) string
+}
+
+// Pruner is implemented by storages keeping data shared by files, Prune removes
+// the data no file refers to
+type Pruner interface {
+	Prune() (PruneResult, error)
+}
+
+type PruneResult struct {
+	Removed int    `json:"removed"`
+	Freed   uint64 `json:"freed_bytes"`
+}
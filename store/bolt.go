@@ -0,0 +1,434 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"go.etcd.io/bbolt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// every namespace is a bucket holding these buckets
+var (
+	dataBucket     = []byte("data")     // uuid -> element
+	orderBucket    = []byte("order")    // sequence -> uuid, keeps the order elements are added
+	sequenceBucket = []byte("sequence") // uuid -> sequence
+	progressBucket = []byte("progress") // uuid -> progress
+	indexBucket    = []byte("index")    // uuid -> indexRecord of indexable elements
+	sortedBucket   = []byte("sorted")   // score and sequence -> uuid of indexable elements
+	filterBucket   = []byte("filter")   // index name and value, score and sequence -> uuid
+)
+
+// BoltBackend keeps everything in a single bolt database file
+type BoltBackend struct {
+	db      *bbolt.DB
+	mutex   sync.Mutex
+	brokers map[string]*broker
+}
+
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltBackend{db: db, brokers: make(map[string]*broker)}, nil
+}
+
+// migrate builds the sorted and filter buckets of the namespaces written
+// before elements were queried through them
+func migrate(db *bbolt.DB) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(_ []byte, ns *bbolt.Bucket) error {
+			if ns.Bucket(sortedBucket) != nil || ns.Bucket(indexBucket) == nil {
+				return nil
+			}
+			for _, name := range [][]byte{sortedBucket, filterBucket} {
+				if _, err := ns.CreateBucket(name); err != nil {
+					return err
+				}
+			}
+			sequences := ns.Bucket(sequenceBucket)
+			return ns.Bucket(indexBucket).ForEach(func(uuid []byte, v []byte) error {
+				return putKeys(ns, uuid, sequences.Get(uuid), parseIndexRecord(v))
+			})
+		})
+	})
+}
+
+func (b *BoltBackend) Namespace(namespace string) Store {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	br, ok := b.brokers[namespace]
+	if !ok {
+		br = newBroker()
+		b.brokers[namespace] = br
+	}
+	return &BoltStore{b.db, []byte(namespace), br}
+}
+
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
+
+type BoltStore struct {
+	db        *bbolt.DB
+	namespace []byte
+	broker    *broker
+}
+
+// update runs fn with the buckets of the namespace, creating them if needed
+func (s *BoltStore) update(fn func(ns *bbolt.Bucket) error) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		ns, err := tx.CreateBucketIfNotExists(s.namespace)
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{dataBucket, orderBucket, sequenceBucket, progressBucket, indexBucket, sortedBucket, filterBucket} {
+			if _, err := ns.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return fn(ns)
+	})
+}
+
+// view runs fn with the buckets of the namespace, ns is nil if nothing has been stored
+func (s *BoltStore) view(fn func(ns *bbolt.Bucket) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		return fn(tx.Bucket(s.namespace))
+	})
+}
+
+func (s *BoltStore) Add(i interface{}, uuid string) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return s.update(func(ns *bbolt.Bucket) error {
+		key := []byte(uuid)
+		if ns.Bucket(sequenceBucket).Get(key) == nil {
+			seq, err := ns.Bucket(orderBucket).NextSequence()
+			if err != nil {
+				return err
+			}
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, seq)
+			if err := ns.Bucket(orderBucket).Put(k, key); err != nil {
+				return err
+			}
+			if err := ns.Bucket(sequenceBucket).Put(key, k); err != nil {
+				return err
+			}
+		}
+		if err := ns.Bucket(dataBucket).Put(key, b); err != nil {
+			return err
+		}
+		return putIndex(ns, key, i)
+	})
+}
+
+// sortKey orders elements by score and then by the order they are added
+func sortKey(score uint64, seq []byte) []byte {
+	k := make([]byte, 8, 16)
+	binary.BigEndian.PutUint64(k, score)
+	return append(k, seq...)
+}
+
+// filterPrefix is the prefix of the keys of the elements whose index name has value
+func filterPrefix(name string, value string) []byte {
+	k := make([]byte, 0, 4+len(name)+len(value))
+	k = append(k, byte(len(name)>>8), byte(len(name)))
+	k = append(k, name...)
+	k = append(k, byte(len(value)>>8), byte(len(value)))
+	return append(k, value...)
+}
+
+// putKeys adds the keys of the sorted and filter buckets of an element,
+// elements which are not in order are never queried
+func putKeys(ns *bbolt.Bucket, uuid []byte, seq []byte, record *indexRecord) error {
+	if record == nil || seq == nil {
+		return nil
+	}
+	key := sortKey(record.Score, seq)
+	if err := ns.Bucket(sortedBucket).Put(key, uuid); err != nil {
+		return err
+	}
+	for name, value := range record.Indexes {
+		if err := ns.Bucket(filterBucket).Put(append(filterPrefix(name, value), key...), uuid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropIndex removes the index of an element
+func dropIndex(ns *bbolt.Bucket, uuid []byte) error {
+	record := parseIndexRecord(ns.Bucket(indexBucket).Get(uuid))
+	if seq := ns.Bucket(sequenceBucket).Get(uuid); record != nil && seq != nil {
+		key := sortKey(record.Score, seq)
+		if err := ns.Bucket(sortedBucket).Delete(key); err != nil {
+			return err
+		}
+		for name, value := range record.Indexes {
+			if err := ns.Bucket(filterBucket).Delete(append(filterPrefix(name, value), key...)); err != nil {
+				return err
+			}
+		}
+	}
+	return ns.Bucket(indexBucket).Delete(uuid)
+}
+
+func putIndex(ns *bbolt.Bucket, key []byte, i interface{}) error {
+	if err := dropIndex(ns, key); err != nil {
+		return err
+	}
+	record := newIndexRecord(i)
+	if record == nil {
+		return nil
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := ns.Bucket(indexBucket).Put(key, b); err != nil {
+		return err
+	}
+	return putKeys(ns, key, ns.Bucket(sequenceBucket).Get(key), record)
+}
+
+func (s *BoltStore) Update(i interface{}, uuid string) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return s.update(func(ns *bbolt.Bucket) error {
+		if err := ns.Bucket(dataBucket).Put([]byte(uuid), b); err != nil {
+			return err
+		}
+		return putIndex(ns, []byte(uuid), i)
+	})
+}
+
+func (s *BoltStore) Load(uuid string) ([]byte, error) {
+	var b []byte
+	err := s.view(func(ns *bbolt.Bucket) error {
+		if ns == nil {
+			return ErrNotFound
+		}
+		v := ns.Bucket(dataBucket).Get([]byte(uuid))
+		if v == nil {
+			return ErrNotFound
+		}
+		// v is only valid in the transaction
+		b = append([]byte{}, v...)
+		return nil
+	})
+	return b, err
+}
+
+func (s *BoltStore) List() ([]string, error) {
+	list := make([]string, 0)
+	err := s.view(func(ns *bbolt.Bucket) error {
+		if ns == nil {
+			return nil
+		}
+		data := ns.Bucket(dataBucket)
+		return ns.Bucket(orderBucket).ForEach(func(_ []byte, uuid []byte) error {
+			if v := data.Get(uuid); v != nil {
+				list = append(list, string(v))
+			}
+			return nil
+		})
+	})
+	return list, err
+}
+
+func (s *BoltStore) Delete(uuid string) error {
+	return s.update(func(ns *bbolt.Bucket) error {
+		key := []byte(uuid)
+		if err := dropIndex(ns, key); err != nil {
+			return err
+		}
+		if seq := ns.Bucket(sequenceBucket).Get(key); seq != nil {
+			if err := ns.Bucket(orderBucket).Delete(seq); err != nil {
+				return err
+			}
+		}
+		for _, name := range [][]byte{dataBucket, sequenceBucket, progressBucket, indexBucket} {
+			if err := ns.Bucket(name).Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) IsExists(uuid string) (bool, error) {
+	ok := false
+	err := s.view(func(ns *bbolt.Bucket) error {
+		ok = ns != nil && ns.Bucket(dataBucket).Get([]byte(uuid)) != nil
+		return nil
+	})
+	return ok, err
+}
+
+func (s *BoltStore) GetProgress(uuid string) (string, error) {
+	progress := ""
+	err := s.view(func(ns *bbolt.Bucket) error {
+		if ns == nil {
+			return ErrNotFound
+		}
+		v := ns.Bucket(progressBucket).Get([]byte(uuid))
+		if v == nil {
+			return ErrNotFound
+		}
+		progress = string(v)
+		return nil
+	})
+	return progress, err
+}
+
+func (s *BoltStore) UpdateProgress(uuid string, i interface{}) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return s.update(func(ns *bbolt.Bucket) error {
+		return ns.Bucket(progressBucket).Put([]byte(uuid), b)
+	})
+}
+
+// Query seeks the keys of the elements within the score range in the sorted bucket, or
+// in the filter bucket under the first filter if there is any. Only the index records of
+// the elements within the range are read if there are more filters, and only the
+// elements of the page are loaded.
+func (s *BoltStore) Query(q Query) ([]string, int, error) {
+	list := make([]string, 0)
+	total := 0
+	err := s.view(func(ns *bbolt.Bucket) error {
+		if ns == nil || ns.Bucket(sortedBucket) == nil {
+			return nil
+		}
+		bucket := ns.Bucket(sortedBucket)
+		prefix := []byte{}
+		names := make([]string, 0, len(q.Filters))
+		for name := range q.Filters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			bucket = ns.Bucket(filterBucket)
+			prefix = filterPrefix(names[0], q.Filters[names[0]])
+		}
+
+		// keys within the range are from low up to but excluding high, nil high is the end of prefix
+		low := sortKey(q.From, nil)
+		var high []byte
+		if q.To > 0 && q.To < math.MaxUint64 {
+			high = append(append([]byte{}, prefix...), sortKey(q.To+1, nil)...)
+		}
+		low = append(append([]byte{}, prefix...), low...)
+		within := func(k []byte) bool {
+			return k != nil && bytes.HasPrefix(k, prefix) && len(k) == len(prefix)+16 &&
+				bytes.Compare(k, low) >= 0 && (high == nil || bytes.Compare(k, high) < 0)
+		}
+
+		c := bucket.Cursor()
+		var k, uuid []byte
+		next := c.Next
+		if q.Desc {
+			next = c.Prev
+			end := high
+			if end == nil {
+				end = prefixEnd(prefix)
+			}
+			if end != nil {
+				k, uuid = c.Seek(end)
+			}
+			if k == nil {
+				k, uuid = c.Last()
+			} else {
+				k, uuid = c.Prev()
+			}
+		} else {
+			k, uuid = c.Seek(low)
+		}
+
+		indexes := ns.Bucket(indexBucket)
+		uuids := make([]string, 0)
+		for ; within(k); k, uuid = next() {
+			if len(names) > 1 {
+				record := parseIndexRecord(indexes.Get(uuid))
+				if record == nil || !record.match(Query{Filters: q.Filters}) {
+					continue
+				}
+			}
+			if total >= q.Offset && (q.Limit <= 0 || len(uuids) < q.Limit) {
+				uuids = append(uuids, string(uuid))
+			}
+			total++
+		}
+
+		data := ns.Bucket(dataBucket)
+		for _, uuid := range uuids {
+			if v := data.Get([]byte(uuid)); v != nil {
+				list = append(list, string(v))
+			}
+		}
+		return nil
+	})
+	return list, total, err
+}
+
+// prefixEnd returns the first key after all keys starting with prefix, nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) Unindexed(names ...string) ([]string, error) {
+	uuids := make([]string, 0)
+	err := s.view(func(ns *bbolt.Bucket) error {
+		if ns == nil {
+			return nil
+		}
+		indexes := ns.Bucket(indexBucket)
+		return ns.Bucket(orderBucket).ForEach(func(_ []byte, uuid []byte) error {
+			var record *indexRecord
+			if indexes != nil {
+				record = parseIndexRecord(indexes.Get(uuid))
+			}
+			if record == nil || !record.has(names) {
+				uuids = append(uuids, string(uuid))
+			}
+			return nil
+		})
+	})
+	return uuids, err
+}
+
+func (s *BoltStore) Publish(i interface{}) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	s.broker.publish(b)
+	return nil
+}
+
+func (s *BoltStore) Subscribe(stop <-chan struct{}) (<-chan []byte, error) {
+	return s.broker.subscribe(stop), nil
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"go.etcd.io/bbolt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openBolt(t *testing.T) (*BoltBackend, string) {
+	dir, err := ioutil.TempDir("", "bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "backup.db")
+	b, err := NewBoltBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, path
+}
+
+func TestBoltQueryKeys(t *testing.T) {
+	b, _ := openBolt(t)
+	defer b.Close()
+	s := b.Namespace("test")
+	for _, e := range []element{
+		{"a", "done", 0},
+		{"b", "done2", 5},
+		{"c", "don", 5},
+		{"d", "done", math.MaxUint64},
+	} {
+		add(t, s, e.Name, e)
+	}
+
+	tests := []struct {
+		name string
+		q    Query
+		want []string
+	}{
+		// values sharing a prefix are told apart
+		{"filter", Query{Filters: map[string]string{"state": "done"}}, []string{"a", "d"}},
+		{"filter desc", Query{Filters: map[string]string{"state": "done"}, Desc: true}, []string{"d", "a"}},
+		{"highest score", Query{To: math.MaxUint64, Desc: true}, []string{"d", "c", "b", "a"}},
+		{"to", Query{To: 5, Desc: true}, []string{"c", "b", "a"}},
+		{"from", Query{From: 6}, []string{"d"}},
+	}
+	for _, test := range tests {
+		list, total, err := s.Query(test.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(t, list); total != len(test.want) || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: %v of %d, want %v", test.name, got, total, test.want)
+		}
+	}
+}
+
+func TestBoltMigrate(t *testing.T) {
+	b, path := openBolt(t)
+	s := b.Namespace("test")
+	add(t, s, "a", element{"a", "done", 2})
+	add(t, s, "b", element{"b", "running", 1})
+	add(t, s, "c", element{"c", "done", 3})
+	// databases written before queries used key-ordered buckets only have the index records
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		ns := tx.Bucket([]byte("test"))
+		if err := ns.DeleteBucket(sortedBucket); err != nil {
+			return err
+		}
+		return ns.DeleteBucket(filterBucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	b, err = NewBoltBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	s = b.Namespace("test")
+	list, total, err := s.Query(Query{Filters: map[string]string{"state": "done"}, Desc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, list); total != 2 || !reflect.DeepEqual(got, []string{"c", "a"}) {
+		t.Errorf("migrated query %v of %d", got, total)
+	}
+	list, _, err = s.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, list); !reflect.DeepEqual(got, []string{"b", "a", "c"}) {
+		t.Errorf("migrated query %v", got)
+	}
+}
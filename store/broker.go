@@ -0,0 +1,44 @@
+package store
+
+import (
+	"sync"
+)
+
+// broker delivers messages to in-process subscribers, it serves
+// the stores which do not have a server to publish through
+type broker struct {
+	mutex       sync.Mutex
+	subscribers map[chan []byte]struct{}
+}
+
+func newBroker() *broker {
+	return &broker{subscribers: make(map[chan []byte]struct{})}
+}
+
+// publish drops the message for subscribers which are not keeping up
+func (b *broker) publish(message []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- message:
+		default:
+		}
+	}
+}
+
+func (b *broker) subscribe(stop <-chan struct{}) <-chan []byte {
+	ch := make(chan []byte, 64)
+	b.mutex.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mutex.Unlock()
+
+	go func() {
+		<-stop
+		b.mutex.Lock()
+		delete(b.subscribers, ch)
+		b.mutex.Unlock()
+		close(ch)
+	}()
+	return ch
+}
@@ -0,0 +1,186 @@
+package store
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// MemoryBackend keeps everything in memory, nothing survives a restart
+type MemoryBackend struct {
+	mutex  sync.Mutex
+	stores map[string]*MemoryStore
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{stores: make(map[string]*MemoryStore)}
+}
+
+func (b *MemoryBackend) Namespace(namespace string) Store {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	s, ok := b.stores[namespace]
+	if !ok {
+		s = &MemoryStore{
+			elements: make(map[string][]byte),
+			progress: make(map[string][]byte),
+			indexes:  make(map[string]*indexRecord),
+			broker:   newBroker(),
+		}
+		b.stores[namespace] = s
+	}
+	return s
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
+
+type MemoryStore struct {
+	mutex    sync.RWMutex
+	order    []string
+	elements map[string][]byte
+	progress map[string][]byte
+	indexes  map[string]*indexRecord
+	broker   *broker
+}
+
+func (s *MemoryStore) Add(i interface{}, uuid string) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.elements[uuid]; !ok {
+		s.order = append(s.order, uuid)
+	}
+	s.elements[uuid] = b
+	s.index(i, uuid)
+	return nil
+}
+
+func (s *MemoryStore) index(i interface{}, uuid string) {
+	if record := newIndexRecord(i); record != nil {
+		s.indexes[uuid] = record
+	} else {
+		delete(s.indexes, uuid)
+	}
+}
+
+func (s *MemoryStore) Update(i interface{}, uuid string) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.elements[uuid] = b
+	s.index(i, uuid)
+	return nil
+}
+
+func (s *MemoryStore) Load(uuid string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	b, ok := s.elements[uuid]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return b, nil
+}
+
+func (s *MemoryStore) List() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	list := make([]string, 0, len(s.order))
+	for _, uuid := range s.order {
+		if b, ok := s.elements[uuid]; ok {
+			list = append(list, string(b))
+		}
+	}
+	return list, nil
+}
+
+func (s *MemoryStore) Delete(uuid string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.elements, uuid)
+	delete(s.progress, uuid)
+	delete(s.indexes, uuid)
+	for i, u := range s.order {
+		if u == uuid {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) IsExists(uuid string) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.elements[uuid]
+	return ok, nil
+}
+
+func (s *MemoryStore) GetProgress(uuid string) (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	b, ok := s.progress[uuid]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return string(b), nil
+}
+
+func (s *MemoryStore) UpdateProgress(uuid string, i interface{}) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.progress[uuid] = b
+	return nil
+}
+
+func (s *MemoryStore) Query(q Query) ([]string, int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	matched := make([]scored, 0)
+	for seq, uuid := range s.order {
+		if record, ok := s.indexes[uuid]; ok && record.match(q) {
+			matched = append(matched, scored{uuid, record.Score, seq})
+		}
+	}
+	list := make([]string, 0)
+	for _, uuid := range page(matched, q) {
+		list = append(list, string(s.elements[uuid]))
+	}
+	return list, len(matched), nil
+}
+
+func (s *MemoryStore) Unindexed(names ...string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	uuids := make([]string, 0)
+	for _, uuid := range s.order {
+		if record, ok := s.indexes[uuid]; !ok || !record.has(names) {
+			uuids = append(uuids, uuid)
+		}
+	}
+	return uuids, nil
+}
+
+func (s *MemoryStore) Publish(i interface{}) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	s.broker.publish(b)
+	return nil
+}
+
+func (s *MemoryStore) Subscribe(stop <-chan struct{}) (<-chan []byte, error) {
+	return s.broker.subscribe(stop), nil
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Indexable is implemented by the elements which can be queried, elements of
+// other types are stored but never returned by Query
+type Indexable interface {
+	// Indexes returns the values elements can be filtered by, such as "state": "running"
+	Indexes() map[string]string
+	// Score returns the value elements are sorted by, usually the creation time
+	Score() uint64
+}
+
+// Query selects a page of the indexed elements of a namespace
+type Query struct {
+	Filters map[string]string // index name to value, elements have to match all of them
+	From    uint64            // lowest score, 0 means no bound
+	To      uint64            // highest score, 0 means no bound
+	Desc    bool              // highest score first
+	Offset  int
+	Limit   int // 0 means no limit
+}
+
+// indexRecord keeps the indexes of an element in the bolt and memory stores
+type indexRecord struct {
+	Score   uint64            `json:"score"`
+	Indexes map[string]string `json:"indexes"`
+}
+
+func newIndexRecord(i interface{}) *indexRecord {
+	e, ok := i.(Indexable)
+	if !ok {
+		return nil
+	}
+	return &indexRecord{e.Score(), e.Indexes()}
+}
+
+func parseIndexRecord(b []byte) *indexRecord {
+	if b == nil {
+		return nil
+	}
+	record := &indexRecord{}
+	if err := json.Unmarshal(b, record); err != nil {
+		return nil
+	}
+	return record
+}
+
+func (r *indexRecord) has(names []string) bool {
+	for _, name := range names {
+		if _, ok := r.Indexes[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *indexRecord) match(q Query) bool {
+	if q.From > 0 && r.Score < q.From {
+		return false
+	}
+	if q.To > 0 && r.Score > q.To {
+		return false
+	}
+	for name, value := range q.Filters {
+		if r.Indexes[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// scored is an element matching a query, seq keeps the order elements are added
+// among the ones with the same score
+type scored struct {
+	uuid  string
+	score uint64
+	seq   int
+}
+
+// page sorts the matching elements and returns the uuids of the page selected by q
+func page(matched []scored, q Query) []string {
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if a.score != b.score {
+			return (a.score < b.score) != q.Desc
+		}
+		return (a.seq < b.seq) != q.Desc
+	})
+	if q.Offset >= len(matched) {
+		return []string{}
+	}
+	matched = matched[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(matched) {
+		matched = matched[:q.Limit]
+	}
+	uuids := make([]string, 0, len(matched))
+	for _, m := range matched {
+		uuids = append(uuids, m.uuid)
+	}
+	return uuids
+}
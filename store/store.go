@@ -0,0 +1,107 @@
+package store
+
+import (
+	"backup/redis"
+	"errors"
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// ErrNotFound is returned when an element or its progress does not exist
+var ErrNotFound = redis.ErrNotFound
+
+// Store keeps the elements of one namespace, such as jobs or repositories,
+// in the order they are added
+type Store interface {
+	Add(i interface{}, uuid string) error
+	Update(i interface{}, uuid string) error
+	Load(uuid string) ([]byte, error)
+	List() ([]string, error)
+	Delete(uuid string) error
+	IsExists(uuid string) (bool, error)
+	GetProgress(uuid string) (string, error)
+	UpdateProgress(uuid string, i interface{}) error
+	// Query returns the page of indexed elements selected by q and the number of all matching ones
+	Query(q Query) ([]string, int, error)
+	// Unindexed returns the uuids of elements stored without indexes, such as the
+	// ones added before their type was Indexable, or without some of the named indexes
+	Unindexed(names ...string) ([]string, error)
+	Publish(i interface{}) error
+	Subscribe(stop <-chan struct{}) (<-chan []byte, error)
+}
+
+// Backend provides the store of every namespace
+type Backend interface {
+	Namespace(namespace string) Store
+	Close() error
+}
+
+// IsUnavailable tells whether err is returned because the store can not be reached
+func IsUnavailable(err error) bool {
+	return redis.IsUnavailable(err)
+}
+
+// Repairer is implemented by the stores whose index can get out of sync with
+// the elements, such as after a crash
+type Repairer interface {
+	Repair() error
+}
+
+// Repair repairs the given namespaces if the backend supports it
+func Repair(backend Backend, namespaces ...string) error {
+	for _, namespace := range namespaces {
+		r, ok := backend.Namespace(namespace).(Repairer)
+		if !ok {
+			continue
+		}
+		if err := r.Repair(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	TypeRedis  = "redis"
+	TypeBolt   = "bolt"
+	TypeMemory = "memory"
+)
+
+type Config struct {
+	Type     string
+	Redis    redis.Config
+	BoltPath string
+}
+
+// Open creates the backend of the configured type
+func Open(c Config) (Backend, error) {
+	switch c.Type {
+	case TypeRedis:
+		return &redisBackend{redis.NewPool(c.Redis)}, nil
+	case TypeBolt:
+		return NewBoltBackend(c.BoltPath)
+	case TypeMemory:
+		return NewMemoryBackend(), nil
+	}
+	return nil, errors.New("unknown store type " + c.Type)
+}
+
+// redisBackend provides a RedisHandler for every namespace, sharing one connection pool
+type redisBackend struct {
+	pool *redigo.Pool
+}
+
+func (b *redisBackend) Namespace(namespace string) Store {
+	return redisStore{redis.New(b.pool, namespace)}
+}
+
+func (b *redisBackend) Close() error {
+	return b.pool.Close()
+}
+
+type redisStore struct {
+	*redis.RedisHandler
+}
+
+func (s redisStore) Query(q Query) ([]string, int, error) {
+	return s.RedisHandler.Query(q.Filters, q.From, q.To, q.Desc, q.Offset, q.Limit)
+}
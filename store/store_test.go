@@ -0,0 +1,330 @@
+package store
+
+import (
+	"backup/redis"
+	"backup/utils"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type element struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Time  uint64 `json:"time"`
+}
+
+func (e element) Indexes() map[string]string {
+	return map[string]string{"state": e.State}
+}
+
+func (e element) Score() uint64 {
+	return e.Time
+}
+
+// plain is an element which can not be queried
+type plain struct {
+	Name string `json:"name"`
+}
+
+// backends opens every backend the tests run against, redis is tested
+// when BACKUP_TEST_REDIS is set to the address of a server
+func backends(t *testing.T) map[string]Backend {
+	backends := map[string]Backend{"memory": NewMemoryBackend()}
+
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	bolt, err := NewBoltBackend(filepath.Join(dir, "backup.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends["bolt"] = bolt
+
+	if address := os.Getenv("BACKUP_TEST_REDIS"); address != "" {
+		backends["redis"] = &redisBackend{redis.NewPool(redis.Config{Address: address, MaxIdle: 2, IdleTimeout: time.Minute})}
+	}
+	for _, b := range backends {
+		b := b
+		t.Cleanup(func() { b.Close() })
+	}
+	return backends
+}
+
+// namespace returns a store of its own for every test, the elements of which
+// are deleted once the test is done
+func namespace(t *testing.T, b Backend) Store {
+	id, err := utils.MakeUuid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := b.Namespace("test-" + id)
+	t.Cleanup(func() {
+		// no element has an index without name, so all of them are returned
+		uuids, _ := s.Unindexed("")
+		for _, uuid := range uuids {
+			s.Delete(uuid)
+		}
+	})
+	return s
+}
+
+func forEachBackend(t *testing.T, test func(t *testing.T, s Store)) {
+	for name, b := range backends(t) {
+		b := b
+		t.Run(name, func(t *testing.T) {
+			test(t, namespace(t, b))
+		})
+	}
+}
+
+func add(t *testing.T, s Store, uuid string, i interface{}) {
+	t.Helper()
+	if err := s.Add(i, uuid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func names(t *testing.T, list []string) []string {
+	t.Helper()
+	names := make([]string, 0, len(list))
+	for _, s := range list {
+		e := element{}
+		if err := json.Unmarshal([]byte(s), &e); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, e.Name)
+	}
+	return names
+}
+
+func TestAddLoad(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		add(t, s, "a", element{Name: "a", State: "queued", Time: 1})
+		b, err := s.Load("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := element{}
+		if err := json.Unmarshal(b, &e); err != nil || e != (element{"a", "queued", 1}) {
+			t.Errorf("loaded %s", b)
+		}
+		if ok, err := s.IsExists("a"); !ok || err != nil {
+			t.Errorf("a exists: %v %v", ok, err)
+		}
+
+		if _, err := s.Load("missing"); err != ErrNotFound {
+			t.Errorf("load missing: %v", err)
+		}
+		if ok, err := s.IsExists("missing"); ok || err != nil {
+			t.Errorf("missing exists: %v %v", ok, err)
+		}
+	})
+}
+
+func TestListDelete(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		// list keeps the order of adding, not the score
+		add(t, s, "c", element{Name: "c", Time: 1})
+		add(t, s, "a", element{Name: "a", Time: 3})
+		add(t, s, "b", element{Name: "b", Time: 2})
+		list, err := s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(t, list); !reflect.DeepEqual(got, []string{"c", "a", "b"}) {
+			t.Errorf("list %v", got)
+		}
+
+		if err := s.Delete("a"); err != nil {
+			t.Fatal(err)
+		}
+		list, err = s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(t, list); !reflect.DeepEqual(got, []string{"c", "b"}) {
+			t.Errorf("list after delete %v", got)
+		}
+		if _, err := s.Load("a"); err != ErrNotFound {
+			t.Errorf("load deleted: %v", err)
+		}
+		if list, total, err := s.Query(Query{}); err != nil || total != 2 || len(list) != 2 {
+			t.Errorf("query after delete: %d of %d, %v", len(list), total, err)
+		}
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		add(t, s, "a", element{Name: "a", State: "queued", Time: 1})
+		add(t, s, "b", element{Name: "b", State: "queued", Time: 2})
+		if err := s.Update(element{Name: "a", State: "running", Time: 1}, "a"); err != nil {
+			t.Fatal(err)
+		}
+
+		list, err := s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(t, list); !reflect.DeepEqual(got, []string{"a", "b"}) {
+			t.Errorf("list %v", got)
+		}
+		for state, want := range map[string][]string{"queued": {"b"}, "running": {"a"}} {
+			list, total, err := s.Query(Query{Filters: map[string]string{"state": state}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(t, list); total != len(want) || !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %v of %d, want %v", state, got, total, want)
+			}
+		}
+	})
+}
+
+func TestProgress(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		add(t, s, "a", element{Name: "a"})
+		if _, err := s.GetProgress("a"); err != ErrNotFound {
+			t.Errorf("progress before update: %v", err)
+		}
+		for _, percent := range []int{10, 20} {
+			if err := s.UpdateProgress("a", map[string]int{"percentage": percent}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		p, err := s.GetProgress("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != `{"percentage":20}` {
+			t.Errorf("progress %s", p)
+		}
+
+		if err := s.Delete("a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetProgress("a"); err != ErrNotFound {
+			t.Errorf("progress of deleted: %v", err)
+		}
+	})
+}
+
+func TestQuery(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		for _, e := range []element{
+			{"a", "done", 10},
+			{"b", "running", 20},
+			{"c", "done", 30},
+			{"d", "done", 20}, // same score as b, added later
+			{"e", "queued", 40},
+		} {
+			add(t, s, e.Name, e)
+		}
+		add(t, s, "p", plain{"p"})
+
+		done := map[string]string{"state": "done"}
+		tests := []struct {
+			name  string
+			q     Query
+			want  []string
+			total int
+		}{
+			{"all", Query{}, []string{"a", "b", "d", "c", "e"}, 5},
+			{"desc", Query{Desc: true}, []string{"e", "c", "d", "b", "a"}, 5},
+			{"filter", Query{Filters: done}, []string{"a", "d", "c"}, 3},
+			{"filter desc", Query{Filters: done, Desc: true}, []string{"c", "d", "a"}, 3},
+			{"no match", Query{Filters: map[string]string{"state": "failed"}}, []string{}, 0},
+			{"unknown index", Query{Filters: map[string]string{"pool": "rbd"}}, []string{}, 0},
+			{"two filters", Query{Filters: map[string]string{"state": "done", "pool": "rbd"}}, []string{}, 0},
+			{"from", Query{From: 20}, []string{"b", "d", "c", "e"}, 4},
+			{"to", Query{To: 20}, []string{"a", "b", "d"}, 3},
+			{"range", Query{From: 15, To: 30, Filters: done}, []string{"d", "c"}, 2},
+			{"limit", Query{Limit: 2}, []string{"a", "b"}, 5},
+			{"offset", Query{Offset: 3, Limit: 10}, []string{"c", "e"}, 5},
+			{"offset desc", Query{Offset: 1, Limit: 2, Desc: true}, []string{"c", "d"}, 5},
+			{"offset past end", Query{Offset: 5}, []string{}, 5},
+			{"filtered page", Query{Filters: done, Offset: 1, Limit: 1}, []string{"d"}, 3},
+		}
+		for _, test := range tests {
+			list, total, err := s.Query(test.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(t, list); total != test.total || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: %v of %d, want %v of %d", test.name, got, total, test.want, test.total)
+			}
+		}
+	})
+}
+
+func TestUnindexed(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		add(t, s, "a", element{Name: "a", State: "done"})
+		add(t, s, "p", plain{"p"})
+		add(t, s, "b", element{Name: "b", State: "done"})
+
+		tests := []struct {
+			names []string
+			want  []string
+		}{
+			{nil, []string{"p"}},
+			{[]string{"state"}, []string{"p"}},
+			{[]string{"state", "pool"}, []string{"a", "p", "b"}},
+		}
+		for _, test := range tests {
+			got, err := s.Unindexed(test.names...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("unindexed %v: %v, want %v", test.names, got, test.want)
+			}
+		}
+
+		// indexing an element drops it from the unindexed ones
+		if err := s.Update(element{Name: "p", State: "done"}, "p"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.Unindexed("state"); err != nil || len(got) != 0 {
+			t.Errorf("unindexed after update: %v %v", got, err)
+		}
+	})
+}
+
+func TestPublish(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		stop := make(chan struct{})
+		messages, err := s.Subscribe(stop)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a server may deliver only the messages published after it subscribed
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		timeout := time.After(5 * time.Second)
+		for {
+			if err := s.Publish(element{Name: "a"}); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case m := <-messages:
+				if string(m) != `{"name":"a","state":"","time":0}` {
+					t.Errorf("message %s", m)
+				}
+				close(stop)
+				return
+			case <-ticker.C:
+			case <-timeout:
+				t.Fatal("no message received")
+			}
+		}
+	})
+}
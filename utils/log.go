@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"log"
+)
+
+var debug = false
+
+// SetLogLevel sets the level of logging, debug or info
+func SetLogLevel(level string) {
+	debug = level == "debug"
+}
+
+// Debug logs the message only if log level is debug
+func Debug(v ...interface{}) {
+	if debug {
+		log.Println(v...)
+	}
+}